@@ -0,0 +1,32 @@
+package messenger
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// Clock tells the time and runs the delayed callbacks, so the
+// retransmissions of a messenger can follow a virtual clock, e.g.
+// the one of a simulation.Network, see WithClock().
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls the f once the duration has passed.
+	AfterFunc(d time.Duration, f func())
+}
+
+// The clock of the system.
+type realClock struct{}
+
+func (realClock) Now() time.Time                      { return time.Now() }
+func (realClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+// Draw a random ID, which tells the incarnations apart
+// no matter how the clocks of the hosts are set.
+func randomID() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
@@ -19,3 +19,10 @@ type Codec interface {
 	// Destroy a codec, release the resource.
 	Destroy() error
 }
+
+// IDRegisterer is implemented by the codecs that can register
+// a message with an explicit ID.
+type IDRegisterer interface {
+	// Register a message type with the ID.
+	RegisterMessageWithID(id uint32, msg interface{}) error
+}
@@ -65,6 +65,57 @@ func TestGoGoProtobufCodec(t *testing.T) {
 	assert.NoError(t, c.Destroy())
 }
 
+// A plain Go struct used for testing the json codec.
+type jsonTestMessage struct {
+	Name   string
+	Values []int
+	Nested map[string]float64
+}
+
+func TestJSONCodec(t *testing.T) {
+	c := NewJSONCodec()
+	assert.NotNil(t, c)
+	assert.NoError(t, c.Initial())
+
+	// Register messages.
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage4{}))
+	assert.NoError(t, c.RegisterMessageWithName("test.plain", jsonTestMessage{}))
+
+	// Should fail because we have already registered once.
+	assert.Error(t, c.RegisterMessage(&example.GoGoProtobufTestMessage4{}))
+	// Should fail because the name is taken.
+	assert.Error(t, c.RegisterMessageWithName("test.plain", &example.GoGoProtobufTestMessage5{}))
+
+	// Try to marshal/unmarshal messages.
+	messages := generateGoGoProtobufMessages()
+	for i := range messages {
+		testMarshalUnmarshal(t, c, messages[i])
+	}
+	testMarshalUnmarshal(t, c, &jsonTestMessage{
+		Name:   "hello",
+		Values: []int{1, 2, 3},
+		Nested: map[string]float64{"pi": 3.14},
+	})
+
+	// The envelope should be self-describing.
+	b, err := c.Marshal(&jsonTestMessage{Name: "world"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"type":"test.plain","body":{"Name":"world","Values":null,"Nested":null}}`, string(b))
+
+	// Try to marshal an unregistered message, should fail.
+	_, err = c.Marshal(&example.GoGoProtobufTestMessage5{})
+	assert.Error(t, err)
+
+	// Try to unmarshal an unknown message, should fail.
+	_, err = c.Unmarshal([]byte(`{"type":"unknown","body":{}}`))
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Destroy())
+}
+
 // Benchmark the Unmarshal() of the raw gogoprotobuf marshal,
 // in order to be compared with the codec.
 func BenchmarkGoGoProtobufWithoutReflectMarshal(b *testing.B) {
@@ -171,3 +222,95 @@ func BenchmarkGoGoProtoBufCodecUnmarshal(b *testing.B) {
 		}
 	}
 }
+
+func TestGoGoProtobufCodecMessageID(t *testing.T) {
+	// Register the messages with explicit IDs in different orders.
+	c1 := NewGoGoProtobufCodec()
+	assert.NoError(t, c1.RegisterMessageWithID(10, &example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c1.RegisterMessageWithID(20, &example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c1.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c1.Initial())
+
+	c2 := NewGoGoProtobufCodec()
+	assert.NoError(t, c2.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c2.RegisterMessageWithID(20, &example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c2.RegisterMessageWithID(10, &example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c2.Initial())
+
+	messages := generateGoGoProtobufMessages()[:3]
+	for i := range messages {
+		b, err := c1.Marshal(messages[i])
+		assert.NoError(t, err)
+		m, err := c2.Unmarshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, messages[i], m)
+	}
+
+	// Should fail because the ID is taken.
+	assert.Error(t, c1.RegisterMessageWithID(10, &example.GoGoProtobufTestMessage4{}))
+	assert.Error(t, c1.Initial())
+}
+
+func TestGoGoProtobufCodecFormat(t *testing.T) {
+	c := NewGoGoProtobufCodec()
+	assert.NoError(t, c.RegisterMessageWithID(1, &example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c.RegisterMessageWithID(255, &example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c.RegisterMessageWithID(256, &example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c.RegisterMessageWithID(maxMessageID, &example.GoGoProtobufTestMessage4{}))
+	assert.NoError(t, c.Initial())
+
+	// IDs beyond one byte should be supported.
+	messages := generateGoGoProtobufMessages()
+	for i := range messages {
+		testMarshalUnmarshal(t, c, messages[i])
+	}
+
+	// Should be able to read the legacy format.
+	legacyIDs := []byte{1, 255}
+	for i := range legacyIDs {
+		b, err := proto.Marshal(messages[i])
+		assert.NoError(t, err)
+		m, err := c.Unmarshal(append(b, legacyIDs[i]))
+		assert.NoError(t, err)
+		assert.Equal(t, messages[i], m)
+	}
+
+	// Should fail on malformed messages.
+	_, err := c.Unmarshal(nil)
+	assert.Error(t, err)
+	_, err = c.Unmarshal([]byte{headerVersion1, 0xff})
+	assert.Error(t, err)
+	// The ID is beyond uint32.
+	_, err = c.Unmarshal([]byte{headerVersion1, 0x80, 0x80, 0x80, 0x80, 0x10, 0x08, 0x01})
+	assert.Error(t, err)
+}
+
+func TestGoGoProtobufCodecNameDerivedID(t *testing.T) {
+	assert.Equal(t, "protobuf.GoGoProtobufTestMessage1", MessageName(&example.GoGoProtobufTestMessage1{}))
+
+	// Register the messages in different orders.
+	c1 := NewGoGoProtobufCodec()
+	c1.EnableNameDerivedIDs()
+	assert.NoError(t, c1.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c1.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c1.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c1.RegisterMessage(&example.GoGoProtobufTestMessage4{}))
+	assert.NoError(t, c1.Initial())
+
+	c2 := NewGoGoProtobufCodec()
+	c2.EnableNameDerivedIDs()
+	assert.NoError(t, c2.RegisterMessage(&example.GoGoProtobufTestMessage4{}))
+	assert.NoError(t, c2.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, c2.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c2.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, c2.Initial())
+
+	messages := generateGoGoProtobufMessages()
+	for i := range messages {
+		b, err := c1.Marshal(messages[i])
+		assert.NoError(t, err)
+		m, err := c2.Unmarshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, messages[i], m)
+	}
+}
@@ -1,15 +1,33 @@
 package codec
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"reflect"
 
 	"code.google.com/p/gogoprotobuf/proto"
-	log "github.com/golang/glog"
+	"github.com/go-distributed/messenger/logger"
 )
 
-// Only support 256 different kinds of messages for now.
-type messageType uint8
+// The maximum message ID, which bounds the
+// IDs decoded from the wire.
+const maxMessageID = math.MaxUint32
+
+// The encoded message is laid out as:
+//
+//	| version (1 byte) | message type (uvarint) | protobuf body |
+//
+// The version byte can never be the first byte of a protobuf
+// body, since wire type 7 is invalid, which tells it apart from
+// the legacy format:
+//
+//	| protobuf body | message type (1 byte) |
+const headerVersion1 = 0x07
+
+// The ID of a message type.
+type messageType uint32
 
 // GoGoProtobufCodec implements the codec interface for Codec.
 // We use reflect to make it a 'self-explained' codec.
@@ -17,20 +35,58 @@ type GoGoProtobufCodec struct {
 	registeredMessages    map[reflect.Type]messageType
 	reversedMap           map[messageType]reflect.Type
 	registeredMessagePtrs map[reflect.Type]messageType
+	nextID                messageType // The next ID in registration order.
+	nameDerivedIDs        bool
+	conflict              error // The first conflicting registration.
+	logger                logger.Logger
 }
 
 // NewGoGoProtobufCodec creates a new gogpprotobuf codec.
-func NewGoGoProtobufCodec() *GoGoProtobufCodec {
+func NewGoGoProtobufCodec(opts ...Option) *GoGoProtobufCodec {
+	o := newOptions(opts)
 	return &GoGoProtobufCodec{
 		registeredMessages:    make(map[reflect.Type]messageType),
 		reversedMap:           make(map[messageType]reflect.Type),
 		registeredMessagePtrs: make(map[reflect.Type]messageType),
+		logger:                o.logger,
 	}
 }
 
-// Initial the gogoprotobuf codec (no-op for now).
+// Initial the gogoprotobuf codec.
+// It fails if any of the registrations had a conflicting ID, so a
+// misconfigured node refuses to start instead of decoding messages
+// into the wrong types.
 func (c *GoGoProtobufCodec) Initial() error {
-	return nil
+	return c.conflict
+}
+
+// EnableNameDerivedIDs makes RegisterMessage derive the message ID from
+// the fully-qualified name of the message instead of the registration
+// order, so nodes agree on the IDs no matter in which order they register
+// the messages. It must be called before registering any message.
+func (c *GoGoProtobufCodec) EnableNameDerivedIDs() {
+	c.nameDerivedIDs = true
+}
+
+// MessageName returns the fully-qualified name of the message.
+// It's the name returned by the XXX_MessageName() method if the message
+// has one, otherwise it's the Go type name qualified by the package name,
+// which is the same as the proto name for the messages generated with
+// the same package name.
+func MessageName(msg interface{}) string {
+	if n, ok := msg.(interface {
+		XXX_MessageName() string
+	}); ok {
+		return n.XXX_MessageName()
+	}
+	return reflect.Indirect(reflect.ValueOf(msg)).Type().String()
+}
+
+// Derive the message ID from the fully-qualified name of the message.
+func nameDerivedID(msg interface{}) messageType {
+	h := fnv.New32a()
+	h.Write([]byte(MessageName(msg)))
+	return messageType(h.Sum32())
 }
 
 // Destroy the gogoprotobuf codec (no-op for now).
@@ -39,7 +95,28 @@ func (c *GoGoProtobufCodec) Destroy() error {
 }
 
 // RegisterMessage regists a message type.
+// The ID of the message is assigned in registration order,
+// or derived from the message name if EnableNameDerivedIDs is called.
 func (c *GoGoProtobufCodec) RegisterMessage(msg interface{}) error {
+	if c.nameDerivedIDs {
+		return c.registerMessage(nameDerivedID(msg), msg)
+	}
+	for {
+		if _, ok := c.reversedMap[c.nextID]; !ok {
+			break
+		}
+		c.nextID++
+	}
+	return c.registerMessage(c.nextID, msg)
+}
+
+// RegisterMessageWithID regists a message type with an explicit ID.
+// Nodes must register the same message with the same ID.
+func (c *GoGoProtobufCodec) RegisterMessageWithID(id uint32, msg interface{}) error {
+	return c.registerMessage(messageType(id), msg)
+}
+
+func (c *GoGoProtobufCodec) registerMessage(mtype messageType, msg interface{}) error {
 	var concreteType reflect.Type
 	var ptrType reflect.Type
 
@@ -58,8 +135,14 @@ func (c *GoGoProtobufCodec) RegisterMessage(msg interface{}) error {
 	if _, ok := msg.(proto.Message); !ok {
 		return fmt.Errorf("Not a protobuf message %v", concreteType)
 	}
+	if t, ok := c.reversedMap[mtype]; ok {
+		err := fmt.Errorf("Message ID %d of %v conflicts with %v", mtype, concreteType, t)
+		if c.conflict == nil {
+			c.conflict = err
+		}
+		return err
+	}
 	// Store the message type.
-	mtype := messageType(len(c.registeredMessages))
 	c.registeredMessages[concreteType] = mtype
 	c.reversedMap[mtype] = concreteType
 	c.registeredMessagePtrs[ptrType] = mtype
@@ -73,7 +156,7 @@ func (c *GoGoProtobufCodec) Marshal(msg interface{}) ([]byte, error) {
 
 	defer func() {
 		if err != nil {
-			log.Warningf("GoGoProtobufCodec: Failed to marshal: %v\n", err)
+			c.logger.Warningf("GoGoProtobufCodec: Failed to marshal: %v\n", err)
 		}
 	}()
 
@@ -87,7 +170,28 @@ func (c *GoGoProtobufCodec) Marshal(msg interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return append(b, byte(mtype)), nil
+
+	data := make([]byte, 1+binary.MaxVarintLen32+len(b))
+	data[0] = headerVersion1
+	n := 1 + binary.PutUvarint(data[1:], uint64(mtype))
+	n += copy(data[n:], b)
+	return data[:n], nil
+}
+
+// Parse the message type and the protobuf body from the encoded message.
+func parseHeader(data []byte) (messageType, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, fmt.Errorf("Empty message")
+	}
+	if len(data) == 1 || data[0] != headerVersion1 {
+		// The legacy format.
+		return messageType(data[len(data)-1]), data[:len(data)-1], nil
+	}
+	mtype, n := binary.Uvarint(data[1:])
+	if n <= 0 || mtype > maxMessageID {
+		return 0, nil, fmt.Errorf("Malformed message type")
+	}
+	return messageType(mtype), data[1+n:], nil
 }
 
 // Unmarshal a message from a byte slice.
@@ -96,17 +200,20 @@ func (c *GoGoProtobufCodec) Unmarshal(data []byte) (interface{}, error) {
 
 	defer func() {
 		if err != nil {
-			log.Warningf("GoGoProtobufCodec: Failed to unmarshal: %v\n", err)
+			c.logger.Warningf("GoGoProtobufCodec: Failed to unmarshal: %v\n", err)
 		}
 	}()
 
-	mtype := messageType(data[len(data)-1])
+	mtype, body, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
 	rtype, ok := c.reversedMap[mtype]
 	if !ok {
 		return nil, fmt.Errorf("Unknown message type: %v", mtype)
 	}
 	msg := reflect.New(rtype).Interface().(proto.Message)
-	if err = proto.Unmarshal(data[0:len(data)-1], msg); err != nil {
+	if err = proto.Unmarshal(body, msg); err != nil {
 		return nil, err
 	}
 	return msg, nil
@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// The self-describing envelope of the json codec.
+type jsonEnvelope struct {
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
+
+// JSONCodec implements the codec interface atop encoding/json.
+// Any Go struct can be registered, the message is encoded as
+// {"type": name, "body": ...} so it's readable by humans and
+// by the peers that are not written in Go.
+type JSONCodec struct {
+	registeredMessages map[reflect.Type]string
+	reversedMap        map[string]reflect.Type
+	logger             logger.Logger
+}
+
+// NewJSONCodec creates a new json codec.
+func NewJSONCodec(opts ...Option) *JSONCodec {
+	o := newOptions(opts)
+	return &JSONCodec{
+		registeredMessages: make(map[reflect.Type]string),
+		reversedMap:        make(map[string]reflect.Type),
+		logger:             o.logger,
+	}
+}
+
+// Initial the json codec (no-op for now).
+func (c *JSONCodec) Initial() error {
+	return nil
+}
+
+// Destroy the json codec (no-op for now).
+func (c *JSONCodec) Destroy() error {
+	return nil
+}
+
+// RegisterMessage regists a message type, the name of
+// the message is the one returned by MessageName().
+func (c *JSONCodec) RegisterMessage(msg interface{}) error {
+	return c.RegisterMessageWithName(MessageName(msg), msg)
+}
+
+// RegisterMessageWithName regists a message type with the
+// name that will be written in the "type" field.
+func (c *JSONCodec) RegisterMessageWithName(name string, msg interface{}) error {
+	concreteType := reflect.Indirect(reflect.ValueOf(msg)).Type()
+	if _, ok := c.registeredMessages[concreteType]; ok {
+		return fmt.Errorf("Message type %v is already registered", concreteType)
+	}
+	if t, ok := c.reversedMap[name]; ok {
+		return fmt.Errorf("Message name %q of %v conflicts with %v", name, concreteType, t)
+	}
+	c.registeredMessages[concreteType] = name
+	c.reversedMap[name] = concreteType
+	return nil
+}
+
+// Marshal a message into a byte slice.
+func (c *JSONCodec) Marshal(msg interface{}) ([]byte, error) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			c.logger.Warningf("JSONCodec: Failed to marshal: %v\n", err)
+		}
+	}()
+
+	// Check if the message is registered.
+	concreteType := reflect.Indirect(reflect.ValueOf(msg)).Type()
+	name, ok := c.registeredMessages[concreteType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown message type: %v", concreteType)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonEnvelope{Type: name, Body: body})
+}
+
+// Unmarshal a message from a byte slice.
+// The returned message is always a pointer.
+func (c *JSONCodec) Unmarshal(data []byte) (interface{}, error) {
+	var err error
+	var e jsonEnvelope
+
+	defer func() {
+		if err != nil {
+			c.logger.Warningf("JSONCodec: Failed to unmarshal: %v\n", err)
+		}
+	}()
+
+	if err = json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	rtype, ok := c.reversedMap[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown message type: %q", e.Type)
+	}
+	msg := reflect.New(rtype).Interface()
+	if err = json.Unmarshal(e.Body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
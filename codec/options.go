@@ -0,0 +1,32 @@
+package codec
+
+import "github.com/go-distributed/messenger/logger"
+
+// The configurable settings of a codec.
+type options struct {
+	logger logger.Logger
+}
+
+func defaultOptions() *options {
+	return &options{
+		logger: logger.Default(),
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Option configures a codec.
+type Option func(*options)
+
+// WithLogger sets the logger, which writes to stderr by default.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
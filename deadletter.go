@@ -0,0 +1,312 @@
+package messenger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// DeadLetterReason tells why a message became a dead letter.
+type DeadLetterReason int
+
+const (
+	// DeadLetterPanic means the handler or an inbound interceptor panicked.
+	DeadLetterPanic DeadLetterReason = iota
+	// DeadLetterUnmarshal means the incoming envelope
+	// or message cannot be decoded.
+	DeadLetterUnmarshal
+	// DeadLetterUnregistered means the type of the incoming
+	// message is not registered in the messenger.
+	DeadLetterUnregistered
+	// DeadLetterNoHandler means there is no handler for the incoming
+	// message, and the receive queue is disabled.
+	DeadLetterNoHandler
+	// DeadLetterMarshal means the outgoing message cannot be encoded.
+	DeadLetterMarshal
+	// DeadLetterSendFailed means the transporter failed to send the
+	// outgoing message, or it's not acknowledged before the deadline.
+	DeadLetterSendFailed
+)
+
+var deadLetterReasons = []string{
+	DeadLetterPanic:        "panic",
+	DeadLetterUnmarshal:    "unmarshal",
+	DeadLetterUnregistered: "unregistered",
+	DeadLetterNoHandler:    "no_handler",
+	DeadLetterMarshal:      "marshal",
+	DeadLetterSendFailed:   "send_failed",
+}
+
+func (r DeadLetterReason) String() string {
+	if r >= 0 && int(r) < len(deadLetterReasons) {
+		return deadLetterReasons[r]
+	}
+	return fmt.Sprintf("DeadLetterReason(%d)", int(r))
+}
+
+// MarshalText encodes the reason as its name.
+func (r DeadLetterReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes the name of a reason.
+func (r *DeadLetterReason) UnmarshalText(b []byte) error {
+	for i, name := range deadLetterReasons {
+		if name == string(b) {
+			*r = DeadLetterReason(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown dead letter reason %q", b)
+}
+
+// Return true if the reason is about an outgoing message.
+func (r DeadLetterReason) outgoing() bool {
+	return r == DeadLetterMarshal || r == DeadLetterSendFailed
+}
+
+// DeadLetter is a message that cannot be handled or sent.
+type DeadLetter struct {
+	Reason DeadLetterReason
+	// When the message became a dead letter.
+	Time time.Time
+	// The sender of an incoming message, or the receiver
+	// of an outgoing one, in the form of host:port.
+	Addr string
+	// The identity of the sender verified by the transporter, nil
+	// if the transporter doesn't authenticate the peers.
+	Peer *transporter.PeerInfo
+	// The Go type of the message, empty if it cannot be decoded.
+	Type string
+	// The envelope as it's received from or sent to the wire,
+	// nil if the outgoing message cannot be encoded.
+	Data []byte
+	// The decoded message, nil if it cannot be decoded or it's read
+	// from a log. Only the Body and the Header are set if it's outgoing.
+	Message *Message
+	// What went wrong, e.g. a *PanicError.
+	Err error
+}
+
+// DeadLetterSink receives the dead letters. It's called from the
+// goroutines of the messenger, so it should not block.
+type DeadLetterSink func(dl *DeadLetter)
+
+// PanicError is a panic recovered from a handler or an interceptor.
+type PanicError struct {
+	// The message being handled, or being sent if an outbound
+	// interceptor panicked.
+	Message *Message
+	// The value passed to panic().
+	Value interface{}
+	// The stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler of %T panicked: %v", e.Message.Body, e.Value)
+}
+
+// Report the panic of a handler or an interceptor, the message goes to
+// the dead-letter sinks if there are any.
+func (m *Messenger) handlePanic(msg *Message, v interface{}, stack []byte) {
+	err := m.reportPanic(msg, v, stack)
+	m.rejectMessage(DeadLetterPanic, msg, err)
+}
+
+// Report the panic of an outbound interceptor, and return the error.
+func (m *Messenger) handleOutgoingPanic(mts *messageToSend, v interface{}, stack []byte) error {
+	err := m.reportPanic(&Message{Body: mts.msg, Header: mts.header}, v, stack)
+	m.rejectOutgoing(DeadLetterPanic, mts, nil, err)
+	return err
+}
+
+// Count the panic and pass it to the error hook, or log it.
+func (m *Messenger) reportPanic(msg *Message, v interface{}, stack []byte) *PanicError {
+	err := &PanicError{Message: msg, Value: v, Stack: stack}
+	m.stats.recordPanic()
+	if m.errorHook != nil {
+		m.errorHook(err)
+	} else {
+		m.logger.Warningf("%v\n%s", err, stack)
+	}
+	return err
+}
+
+// Pass the dead letter to the sinks.
+func (m *Messenger) deadLetter(dl *DeadLetter) {
+	if len(m.deadLetters) == 0 {
+		return
+	}
+	if dl.Time.IsZero() {
+		dl.Time = time.Now()
+	}
+	for _, sink := range m.deadLetters {
+		sink(dl)
+	}
+}
+
+// Report an incoming message that cannot be handled.
+func (m *Messenger) rejectMessage(reason DeadLetterReason, msg *Message, err error) {
+	m.deadLetter(&DeadLetter{
+		Reason:  reason,
+		Addr:    msg.From,
+		Peer:    msg.Peer,
+		Type:    typeName(msg.Body),
+		Data:    msg.raw,
+		Message: msg,
+		Err:     err,
+	})
+}
+
+// Report an outgoing message that cannot be sent.
+func (m *Messenger) rejectOutgoing(reason DeadLetterReason, mts *messageToSend, data []byte, err error) {
+	m.deadLetter(&DeadLetter{
+		Reason:  reason,
+		Addr:    mts.hostport,
+		Type:    typeName(mts.msg),
+		Data:    data,
+		Message: &Message{Body: mts.msg, Header: mts.header},
+		Err:     err,
+	})
+}
+
+// The name of the type of the message, or "" if it's nil.
+func typeName(msg interface{}) string {
+	if msg == nil {
+		return ""
+	}
+	return reflect.TypeOf(msg).String()
+}
+
+// Replay passes the dead letter through the messenger again, e.g.
+// after the missing handler is registered. An incoming message is
+// decoded and queued as if it's just received, an outgoing one is
+// decoded and queued to be sent again, as if it's just sent.
+// The messenger must be started.
+func (m *Messenger) Replay(dl *DeadLetter) error {
+	if dl.Data == nil {
+		return fmt.Errorf("Cannot replay a dead letter without data")
+	}
+	e, err := unmarshalEnvelope(dl.Data)
+	if err != nil {
+		return err
+	}
+	if !dl.Reason.outgoing() {
+		return m.receive(dl.Addr, dl.Peer, dl.Data, e)
+	}
+	msg, err := m.codec.Unmarshal(e.payload)
+	if err != nil {
+		return err
+	}
+	// The epoch and the sequence number are assigned again.
+	return m.send(context.Background(), &messageToSend{
+		hostport: dl.Addr,
+		msg:      msg,
+		kind:     e.kind,
+		id:       e.id,
+		header:   e.header,
+	})
+}
+
+// DeadLetterLog appends the dead letters to a file, one JSON
+// object per line, so they can be inspected and replayed later.
+type DeadLetterLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// The dead letter as it's written to the log.
+type deadLetterRecord struct {
+	Reason   DeadLetterReason `json:"reason"`
+	Time     time.Time        `json:"time"`
+	Addr     string           `json:"addr"`
+	Peer     string           `json:"peer,omitempty"`
+	DNSNames []string         `json:"dns_names,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Data     []byte           `json:"data,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// OpenDeadLetterLog opens the log at the path for appending,
+// the file is created if it doesn't exist.
+func OpenDeadLetterLog(path string) (*DeadLetterLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends the dead letter to the log.
+func (l *DeadLetterLog) Write(dl *DeadLetter) error {
+	r := &deadLetterRecord{
+		Reason: dl.Reason,
+		Time:   dl.Time,
+		Addr:   dl.Addr,
+		Type:   dl.Type,
+		Data:   dl.Data,
+	}
+	if dl.Peer != nil {
+		r.Peer = dl.Peer.CommonName
+		r.DNSNames = dl.Peer.DNSNames
+	}
+	if dl.Err != nil {
+		r.Error = dl.Err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(r)
+}
+
+// Close the log.
+func (l *DeadLetterLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// ReadDeadLetters reads the dead letters from the log at the path
+// in the order they are written. The messages are not decoded, and
+// the errors only keep their texts.
+func ReadDeadLetters(path string) ([]*DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dls []*DeadLetter
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var r deadLetterRecord
+		if err := dec.Decode(&r); err != nil {
+			return dls, err
+		}
+		dl := &DeadLetter{
+			Reason: r.Reason,
+			Time:   r.Time,
+			Addr:   r.Addr,
+			Type:   r.Type,
+			Data:   r.Data,
+		}
+		if r.Peer != "" || len(r.DNSNames) > 0 {
+			dl.Peer = &transporter.PeerInfo{CommonName: r.Peer, DNSNames: r.DNSNames}
+		}
+		if r.Error != "" {
+			dl.Err = errors.New(r.Error)
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
@@ -0,0 +1,106 @@
+package messenger
+
+import (
+	"hash/fnv"
+	"reflect"
+)
+
+// DispatchMode controls how the messages are passed to the handlers.
+type DispatchMode int
+
+const (
+	// DispatchInline invokes the handlers one by one in the
+	// reading loop, so a slow handler stalls all the messages.
+	DispatchInline DispatchMode = iota
+	// DispatchConcurrent invokes the handlers on a pool of
+	// workers without any ordering.
+	DispatchConcurrent
+	// DispatchOrderedByType invokes the handlers on a pool of
+	// workers, messages of the same type are handled in order.
+	DispatchOrderedByType
+	// DispatchOrderedBySender invokes the handlers on a pool of
+	// workers, messages from the same sender are handled in order.
+	DispatchOrderedBySender
+)
+
+// The default number of workers of the dispatcher.
+const defaultWorkers = 8
+
+// A message waiting for its handler.
+type dispatchTask struct {
+	msg     *Message
+	handler MessageHandler
+}
+
+// The dispatcher passes the messages to the handlers.
+// For the ordered modes, each worker has its own queue and the
+// messages of the same key always go to the same worker.
+type dispatcher struct {
+	mode   DispatchMode
+	queues []chan *dispatchTask
+	invoke func(*Message, MessageHandler)
+}
+
+func newDispatcher(mode DispatchMode, workers int, invoke func(*Message, MessageHandler)) *dispatcher {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	d := &dispatcher{mode: mode, invoke: invoke}
+	switch mode {
+	case DispatchInline:
+	case DispatchConcurrent:
+		// All the workers share one queue.
+		queue := make(chan *dispatchTask, defaultQueueSize)
+		for i := 0; i < workers; i++ {
+			d.queues = append(d.queues, queue)
+		}
+	default:
+		for i := 0; i < workers; i++ {
+			d.queues = append(d.queues, make(chan *dispatchTask, defaultQueueSize))
+		}
+	}
+	return d
+}
+
+// Start the workers, they will exit once the stop is closed.
+func (d *dispatcher) start(stop chan struct{}) {
+	for i := range d.queues {
+		go d.work(d.queues[i], stop)
+	}
+}
+
+func (d *dispatcher) work(queue chan *dispatchTask, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case task := <-queue:
+			d.invoke(task.msg, task.handler)
+		}
+	}
+}
+
+// Pass the message to the handler according to the mode.
+// This will block if the queue of the worker is full.
+func (d *dispatcher) dispatch(msg *Message, h MessageHandler, stop chan struct{}) {
+	if d.mode == DispatchInline {
+		d.invoke(msg, h)
+		return
+	}
+
+	var key string
+	switch d.mode {
+	case DispatchOrderedByType:
+		key = reflect.TypeOf(msg.Body).String()
+	case DispatchOrderedBySender:
+		key = msg.From
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	queue := d.queues[hash.Sum32()%uint32(len(d.queues))]
+
+	select {
+	case queue <- &dispatchTask{msg, h}:
+	case <-stop:
+	}
+}
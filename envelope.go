@@ -0,0 +1,174 @@
+package messenger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Header is the key/value metadata sent along with a message,
+// like a trace ID, a timestamp or a deadline.
+type Header map[string]string
+
+// The kind of an envelope.
+type envelopeKind uint8
+
+const (
+	// A one-way message sent by Send().
+	kindMessage envelopeKind = iota
+	// A request sent by Call(), which expects a response.
+	kindRequest
+	// A response to a request.
+	kindResponse
+	// An acknowledgement of a reliable message, no payload.
+	kindAck
+)
+
+// The first byte of a versioned envelope has the high bit set, so
+// it can be told from the version 1 envelope, which starts with the kind.
+const (
+	versionFlag     = 0x80
+	envelopeVersion = 2
+)
+
+// The envelope wraps the encoded message on the wire.
+// The layout is:
+//
+//	| 0x80 | version (1 byte) | kind (1 byte) | id (uvarint) | epoch (uvarint) | seq (uvarint) |
+//	| header count (uvarint) | key length (uvarint) | key | value length (uvarint) | value | ... | payload |
+//
+// The version 1 envelope has no version byte nor the headers.
+// The response of a request is sent back to the origin
+// address reported by the transporter.
+//
+// The bytes that are not an envelope are taken as a bare codec payload,
+// which is what a peer that predates the envelope sends, and what a client
+// that only speaks the codec can send, e.g. by posting a JSON message.
+// They are delivered as one-way messages. A payload can only be mistaken
+// for an envelope if it starts with 0x00-0x03 or 0x82 and above, which no
+// payload of the codecs does, except a protobuf body whose first field is
+// 16 or above in the legacy format. The bytes that start with 0x82 and above
+// are never taken as a payload, so a truncated envelope or the one of a
+// newer version is reported as an error.
+type envelope struct {
+	kind    envelopeKind
+	id      uint64 // Correlation ID of a request or response.
+	epoch   uint64 // Identifies the incarnation of a reliable sender.
+	seq     uint64 // Sequence number of a reliable message, 0 otherwise.
+	header  Header
+	payload []byte // The message encoded by the codec.
+}
+
+// Marshal the envelope into bytes.
+// The headers are sorted by the keys.
+func (e *envelope) marshal() []byte {
+	size := 2 + 4*binary.MaxVarintLen64 + len(e.payload)
+	keys := make([]string, 0, len(e.header))
+	for k, v := range e.header {
+		keys = append(keys, k)
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+	b := make([]byte, size)
+
+	b[0] = versionFlag | envelopeVersion
+	b[1] = byte(e.kind)
+	n := 2
+	n += binary.PutUvarint(b[n:], e.id)
+	n += binary.PutUvarint(b[n:], e.epoch)
+	n += binary.PutUvarint(b[n:], e.seq)
+	n += binary.PutUvarint(b[n:], uint64(len(keys)))
+	for _, k := range keys {
+		n += binary.PutUvarint(b[n:], uint64(len(k)))
+		n += copy(b[n:], k)
+		n += binary.PutUvarint(b[n:], uint64(len(e.header[k])))
+		n += copy(b[n:], e.header[k])
+	}
+	n += copy(b[n:], e.payload)
+	return b[:n]
+}
+
+// Unmarshal an envelope from bytes, or wrap
+// the bytes if they are a bare codec payload.
+func unmarshalEnvelope(b []byte) (*envelope, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Empty envelope")
+	}
+	if b[0] < versionFlag|envelopeVersion && envelopeKind(b[0]) > kindAck {
+		return &envelope{kind: kindMessage, payload: b}, nil
+	}
+	e, err := parseEnvelope(b)
+	if err != nil {
+		if b[0] >= versionFlag|envelopeVersion {
+			return nil, err
+		}
+		return &envelope{kind: kindMessage, payload: b}, nil
+	}
+	return e, nil
+}
+
+// Parse the envelope in the bytes.
+func parseEnvelope(b []byte) (*envelope, error) {
+	version := 1
+	if b[0]&versionFlag != 0 {
+		version = int(b[0] &^ versionFlag)
+		if version != envelopeVersion {
+			return nil, fmt.Errorf("Unsupported envelope version: %d", version)
+		}
+		b = b[1:]
+		if len(b) == 0 {
+			return nil, fmt.Errorf("Empty envelope")
+		}
+	}
+
+	e := &envelope{kind: envelopeKind(b[0])}
+	if e.kind > kindAck {
+		return nil, fmt.Errorf("Unknown envelope kind: %v", e.kind)
+	}
+	n := 1
+	for _, field := range []*uint64{&e.id, &e.epoch, &e.seq} {
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return nil, fmt.Errorf("Malformed envelope header")
+		}
+		*field = v
+		n += m
+	}
+
+	if version >= 2 {
+		count, m := binary.Uvarint(b[n:])
+		if m <= 0 || count > uint64(len(b)) {
+			return nil, fmt.Errorf("Malformed envelope header")
+		}
+		n += m
+		if count > 0 {
+			e.header = make(Header, count)
+		}
+		for i := uint64(0); i < count; i++ {
+			k, m := readString(b[n:])
+			if m <= 0 {
+				return nil, fmt.Errorf("Malformed envelope header")
+			}
+			n += m
+			v, m := readString(b[n:])
+			if m <= 0 {
+				return nil, fmt.Errorf("Malformed envelope header")
+			}
+			n += m
+			e.header[k] = v
+		}
+	}
+
+	e.payload = b[n:]
+	return e, nil
+}
+
+// Read a string prefixed by its length, return the string
+// and the bytes read, or 0 if the bytes are malformed.
+func readString(b []byte) (string, int) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return "", 0
+	}
+	return string(b[n : n+int(l)]), n + int(l)
+}
@@ -0,0 +1,17 @@
+package gossip
+
+import "time"
+
+// Clock tells the time, so the tests can drive the gossip with a
+// fake clock. It's the same as the membership.Clock, so a node can
+// share one clock between the two.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// The clock of the system.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
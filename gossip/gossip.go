@@ -0,0 +1,317 @@
+// Package gossip disseminates updates atop a messenger. Instead
+// of sending every update to every node, each node periodically
+// sends the recent updates to a few random peers, which pass them
+// on. An update is retransmitted for a number of rounds that grows
+// with log(N), and delivered to the handler once on every node.
+package gossip
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/logger"
+)
+
+// Message is an update delivered by the gossip.
+type Message struct {
+	// The address of the node that broadcast the update.
+	Origin string
+	// The address of the peer that passed the update on.
+	From string
+	// The decoded message.
+	Body interface{}
+}
+
+// Handler is a callback that handles the updates.
+type Handler func(msg *Message)
+
+// The ID of an update. The sequence numbers start over when the
+// origin restarts, so the incarnation tells the updates apart.
+type updateID struct {
+	origin      string
+	incarnation uint64
+	seq         uint64
+}
+
+func idOf(u *Update) updateID {
+	return updateID{u.GetOrigin(), u.GetIncarnation(), u.GetSeq()}
+}
+
+// An update waiting to be retransmitted.
+type pendingUpdate struct {
+	update    *Update
+	transmits int
+}
+
+// Gossip broadcasts the updates to all the peers.
+type Gossip struct {
+	m      *messenger.Messenger
+	codec  codec.Codec // For the updates.
+	clock  Clock
+	logger logger.Logger
+
+	interval       time.Duration
+	fanout         int
+	retransmitMult int
+	maxUpdates     int
+	seenTTL        time.Duration
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	handler     Handler
+	undelivered []*Message // Received before the handler is set.
+	peers       map[string]bool
+	incarnation uint64
+	seq         uint64
+	pending     map[updateID]*pendingUpdate
+	seen        map[updateID]time.Time // When the update is received.
+	stop        chan struct{}
+	running     bool
+}
+
+// New creates a gossip atop the messenger, the updates are
+// marshalled by the codec. It registers the packet to the
+// messenger, so it must be called before the messenger is started.
+// The messenger should have the handlers enabled.
+func New(m *messenger.Messenger, c codec.Codec, opts ...Option) (*Gossip, error) {
+	o := newOptions(opts)
+	g := &Gossip{
+		m:              m,
+		codec:          c,
+		clock:          o.clock,
+		logger:         o.logger,
+		interval:       o.interval,
+		fanout:         o.fanout,
+		retransmitMult: o.retransmitMult,
+		maxUpdates:     o.maxUpdates,
+		seenTTL:        o.seenTTL,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		peers:          make(map[string]bool),
+		incarnation:    uint64(time.Now().UnixNano()),
+		pending:        make(map[updateID]*pendingUpdate),
+		seen:           make(map[updateID]time.Time),
+		stop:           make(chan struct{}),
+	}
+	if err := m.RegisterMessage(&Packet{}); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterHandler(&Packet{}, g.handlePacket); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// RegisterMessage regists a message that can be broadcast.
+func (g *Gossip) RegisterMessage(msg interface{}) error {
+	return g.codec.RegisterMessage(msg)
+}
+
+// SetHandler sets the callback of the updates, which is invoked
+// once for each update. The updates received before the handler
+// is set are passed to it at once.
+func (g *Gossip) SetHandler(h Handler) {
+	g.mu.Lock()
+	g.handler = h
+	undelivered := g.undelivered
+	g.undelivered = nil
+	g.mu.Unlock()
+
+	for _, msg := range undelivered {
+		h(msg)
+	}
+}
+
+// AddPeer adds a peer to gossip with.
+func (g *Gossip) AddPeer(hostport string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if hostport != g.m.Addr() {
+		g.peers[hostport] = true
+	}
+}
+
+// RemovePeer removes a peer.
+func (g *Gossip) RemovePeer(hostport string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.peers, hostport)
+}
+
+// Start gossiping periodically. It can be started again after Stop().
+func (g *Gossip) Start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running {
+		return
+	}
+	g.running = true
+	g.stop = make(chan struct{})
+	go g.loop(g.stop)
+}
+
+// Stop gossiping.
+func (g *Gossip) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.running {
+		return
+	}
+	g.running = false
+	close(g.stop)
+}
+
+// Broadcast queues the message to be gossiped to all the peers.
+// The local handler is not invoked.
+func (g *Gossip) Broadcast(msg interface{}) error {
+	payload, err := g.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	u := &Update{
+		Origin:      proto.String(g.m.Addr()),
+		Seq:         proto.Uint64(g.seq),
+		Payload:     payload,
+		Incarnation: proto.Uint64(g.incarnation),
+	}
+	id := idOf(u)
+	g.seen[id] = g.clock.Now()
+	g.pending[id] = &pendingUpdate{update: u}
+	return nil
+}
+
+// Pending returns the number of the updates that
+// are not retransmitted enough yet.
+func (g *Gossip) Pending() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.pending)
+}
+
+// The number of rounds an update is gossiped to n peers.
+func retransmitLimit(mult, n int) int {
+	return mult * int(math.Ceil(math.Log10(float64(n+1))))
+}
+
+func (g *Gossip) loop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-g.clock.After(g.interval):
+			g.round()
+		}
+	}
+}
+
+// Send the pending updates to random peers.
+func (g *Gossip) round() {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	for id, t := range g.seen {
+		if now.Sub(t) > g.seenTTL {
+			delete(g.seen, id)
+		}
+	}
+	if len(g.pending) == 0 || len(g.peers) == 0 {
+		g.mu.Unlock()
+		return
+	}
+
+	// The least transmitted updates go first.
+	pending := make([]*pendingUpdate, 0, len(g.pending))
+	for _, p := range g.pending {
+		pending = append(pending, p)
+	}
+	sort.Sort(byTransmits(pending))
+	if len(pending) > g.maxUpdates {
+		pending = pending[:g.maxUpdates]
+	}
+
+	limit := retransmitLimit(g.retransmitMult, len(g.peers))
+	msg := &Packet{}
+	for _, p := range pending {
+		msg.Updates = append(msg.Updates, p.update)
+		p.transmits++
+		if p.transmits >= limit {
+			delete(g.pending, idOf(p.update))
+		}
+	}
+	peers := g.pickPeers()
+	g.mu.Unlock()
+
+	for _, peer := range peers {
+		if err := g.m.Send(peer, msg); err != nil {
+			g.logger.Warningf("Gossip: Failed to send to %v: %v\n", peer, err)
+		}
+	}
+}
+
+type byTransmits []*pendingUpdate
+
+func (b byTransmits) Len() int           { return len(b) }
+func (b byTransmits) Less(i, j int) bool { return b[i].transmits < b[j].transmits }
+func (b byTransmits) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Pick the fanout random peers, the caller must hold the lock.
+func (g *Gossip) pickPeers() []string {
+	peers := make([]string, 0, len(g.peers))
+	for peer := range g.peers {
+		peers = append(peers, peer)
+	}
+	// Sort first so the picks only depend on the random source.
+	sort.Strings(peers)
+	for i := range peers {
+		j := i + g.rand.Intn(len(peers)-i)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	if len(peers) > g.fanout {
+		peers = peers[:g.fanout]
+	}
+	return peers
+}
+
+func (g *Gossip) handlePacket(msg *messenger.Message) {
+	now := g.clock.Now()
+	var fresh []*Message
+
+	g.mu.Lock()
+	for _, u := range msg.Body.(*Packet).GetUpdates() {
+		id := idOf(u)
+		if _, ok := g.seen[id]; ok {
+			continue
+		}
+		g.seen[id] = now
+		g.pending[id] = &pendingUpdate{update: u}
+
+		body, err := g.codec.Unmarshal(u.GetPayload())
+		if err != nil {
+			g.logger.Warningf("Gossip: Failed to unmarshal the update from %v: %v\n", u.GetOrigin(), err)
+			continue
+		}
+		fresh = append(fresh, &Message{Origin: u.GetOrigin(), From: msg.From, Body: body})
+	}
+	h := g.handler
+	if h == nil {
+		// Keep them until the handler is set.
+		g.undelivered = append(g.undelivered, fresh...)
+	}
+	g.mu.Unlock()
+
+	if h == nil {
+		return
+	}
+	for _, m := range fresh {
+		h(m)
+	}
+}
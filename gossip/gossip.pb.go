@@ -0,0 +1,73 @@
+// Code generated by protoc-gen-gogo.
+// source: gossip.proto
+// DO NOT EDIT!
+
+package gossip
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type Update struct {
+	Origin           *string `protobuf:"bytes,1,req,name=origin" json:"origin,omitempty"`
+	Seq              *uint64 `protobuf:"varint,2,req,name=seq" json:"seq,omitempty"`
+	Payload          []byte  `protobuf:"bytes,3,req,name=payload" json:"payload,omitempty"`
+	Incarnation      *uint64 `protobuf:"varint,4,opt,name=incarnation" json:"incarnation,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Update) Reset()         { *m = Update{} }
+func (m *Update) String() string { return proto.CompactTextString(m) }
+func (*Update) ProtoMessage()    {}
+
+func (m *Update) GetOrigin() string {
+	if m != nil && m.Origin != nil {
+		return *m.Origin
+	}
+	return ""
+}
+
+func (m *Update) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *Update) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *Update) GetIncarnation() uint64 {
+	if m != nil && m.Incarnation != nil {
+		return *m.Incarnation
+	}
+	return 0
+}
+
+type Packet struct {
+	Updates          []*Update `protobuf:"bytes,1,rep,name=updates" json:"updates,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Packet) Reset()         { *m = Packet{} }
+func (m *Packet) String() string { return proto.CompactTextString(m) }
+func (*Packet) ProtoMessage()    {}
+
+func (m *Packet) GetUpdates() []*Update {
+	if m != nil {
+		return m.Updates
+	}
+	return nil
+}
+
+func init() {
+}
@@ -0,0 +1,236 @@
+package gossip
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/membership"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Count the deliveries of each update.
+type deliveryCounter struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (c *deliveryCounter) handle(msg *Message) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[msg.Body.(*example.GoGoProtobufTestMessage1).GetF1()]++
+}
+
+func (c *deliveryCounter) snapshot() map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	counts := make(map[string]int)
+	for k, v := range c.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func TestRetransmitLimit(t *testing.T) {
+	assert.Equal(t, 3, retransmitLimit(3, 1))
+	assert.Equal(t, 6, retransmitLimit(3, 10))
+	assert.Equal(t, 9, retransmitLimit(3, 100))
+	assert.Equal(t, 12, retransmitLimit(3, 1000))
+}
+
+func TestGossip(t *testing.T) {
+	const n = 20
+	network := transporter.NewMemoryNetwork()
+
+	var addrs []string
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, fmt.Sprintf("node%d", i))
+	}
+
+	var messengers []*messenger.Messenger
+	var gossips []*Gossip
+	var counters []*deliveryCounter
+	for _, addr := range addrs {
+		m := messenger.New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, addr), false, true)
+		assert.NotNil(t, m)
+		g, err := New(m, codec.NewGoGoProtobufCodec(), WithInterval(time.Millisecond*10), WithRetransmitMult(4))
+		assert.NoError(t, err)
+		assert.NoError(t, g.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		for _, peer := range addrs {
+			g.AddPeer(peer)
+		}
+		c := &deliveryCounter{counts: make(map[string]int)}
+		g.SetHandler(c.handle)
+		assert.NoError(t, m.Start())
+		g.Start()
+
+		messengers = append(messengers, m)
+		gossips = append(gossips, g)
+		counters = append(counters, c)
+	}
+
+	const updates = 5
+	for i := 0; i < updates; i++ {
+		assert.NoError(t, gossips[i].Broadcast(&example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String(fmt.Sprintf("update%d", i)),
+			F2: proto.Float32(4.2),
+		}))
+	}
+	// Should fail because the message is not registered.
+	assert.Error(t, gossips[0].Broadcast(&example.GoGoProtobufTestMessage2{}))
+
+	// Wait until all the updates stop spreading.
+	for i := 0; i < 500; i++ {
+		pending := 0
+		for _, g := range gossips {
+			pending += g.Pending()
+		}
+		if pending == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Every node should get every update once, except its own.
+	for i, c := range counters {
+		counts := c.snapshot()
+		for j := 0; j < updates; j++ {
+			expected := 1
+			if i == j {
+				expected = 0
+			}
+			assert.Equal(t, expected, counts[fmt.Sprintf("update%d", j)], "node%d update%d", i, j)
+		}
+	}
+
+	for i := range gossips {
+		assert.Equal(t, 0, gossips[i].Pending())
+		gossips[i].Stop()
+		assert.NoError(t, messengers[i].Stop())
+	}
+}
+
+func TestRestart(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	newNode := func(addr string, c *deliveryCounter) (*messenger.Messenger, *Gossip) {
+		m := messenger.New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, addr), false, true)
+		assert.NotNil(t, m)
+		g, err := New(m, codec.NewGoGoProtobufCodec(), WithInterval(time.Millisecond*10))
+		assert.NoError(t, err)
+		assert.NoError(t, g.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		g.AddPeer("a")
+		g.AddPeer("b")
+		g.SetHandler(c.handle)
+		assert.NoError(t, m.Start())
+		g.Start()
+		return m, g
+	}
+	broadcast := func(g *Gossip, name string) {
+		assert.NoError(t, g.Broadcast(&example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(1),
+			F1: proto.String(name),
+			F2: proto.Float32(4.2),
+		}))
+	}
+	waitFor := func(c *deliveryCounter, name string) {
+		for i := 0; i < 100 && c.snapshot()[name] == 0; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, 1, c.snapshot()[name], name)
+	}
+
+	counter := &deliveryCounter{counts: make(map[string]int)}
+	ma, ga := newNode("a", &deliveryCounter{counts: make(map[string]int)})
+	mb, gb := newNode("b", counter)
+	broadcast(ga, "first")
+	waitFor(counter, "first")
+
+	// Should deliver the updates of the restarted origin,
+	// even though the sequence numbers start over.
+	ga.Stop()
+	assert.NoError(t, ma.Stop())
+	ma, ga = newNode("a", &deliveryCounter{counts: make(map[string]int)})
+	broadcast(ga, "second")
+	waitFor(counter, "second")
+
+	// Should keep gossiping once started again.
+	ga.Stop()
+	ga.Start()
+	broadcast(ga, "third")
+	waitFor(counter, "third")
+
+	ga.Stop()
+	gb.Stop()
+	assert.NoError(t, ma.Stop())
+	assert.NoError(t, mb.Stop())
+}
+
+func TestLateHandler(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	clock := membership.NewFakeClock(time.Now())
+	newNode := func(addr string) (*messenger.Messenger, *Gossip) {
+		m := messenger.New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, addr), false, true)
+		assert.NotNil(t, m)
+		g, err := New(m, codec.NewGoGoProtobufCodec(), WithClock(clock), WithInterval(time.Second),
+			WithSeenTTL(time.Minute))
+		assert.NoError(t, err)
+		assert.NoError(t, g.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		g.AddPeer("a")
+		g.AddPeer("b")
+		assert.NoError(t, m.Start())
+		g.Start()
+		return m, g
+	}
+	// Advance the clock once both loops are waiting.
+	advance := func(d time.Duration) {
+		for i := 0; i < 100 && clock.Waiters() < 2; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(d)
+	}
+
+	ma, ga := newNode("a")
+	mb, gb := newNode("b")
+	assert.NoError(t, ga.Broadcast(&example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("early"),
+		F2: proto.Float32(4.2),
+	}))
+	for i := 0; i < 100 && gb.Pending() == 0; i++ {
+		advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Should deliver the update received before the handler is set.
+	c := &deliveryCounter{counts: make(map[string]int)}
+	gb.SetHandler(c.handle)
+	assert.Equal(t, map[string]int{"early": 1}, c.snapshot())
+
+	// Should forget the updates by the clock, once they stop spreading.
+	for i := 0; i < 100 && ga.Pending()+gb.Pending() > 0; i++ {
+		advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	advance(time.Minute * 2)
+	forgotten := false
+	for i := 0; i < 100 && !forgotten; i++ {
+		gb.mu.Lock()
+		forgotten = len(gb.seen) == 0
+		gb.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, forgotten)
+	assert.Equal(t, map[string]int{"early": 1}, c.snapshot())
+
+	ga.Stop()
+	gb.Stop()
+	assert.NoError(t, ma.Stop())
+	assert.NoError(t, mb.Stop())
+}
@@ -0,0 +1,101 @@
+package gossip
+
+import (
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// The default settings of the gossip.
+const (
+	defaultInterval       = time.Millisecond * 200
+	defaultFanout         = 3
+	defaultRetransmitMult = 3
+	defaultMaxUpdates     = 64
+	defaultSeenTTL        = time.Minute
+)
+
+// The configurable settings of a gossip.
+type options struct {
+	interval       time.Duration
+	fanout         int
+	retransmitMult int
+	maxUpdates     int
+	seenTTL        time.Duration
+	clock          Clock
+	logger         logger.Logger
+}
+
+func defaultOptions() *options {
+	return &options{
+		interval:       defaultInterval,
+		fanout:         defaultFanout,
+		retransmitMult: defaultRetransmitMult,
+		maxUpdates:     defaultMaxUpdates,
+		seenTTL:        defaultSeenTTL,
+		clock:          realClock{},
+		logger:         logger.Default(),
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Option configures a gossip, see New().
+type Option func(*options)
+
+// WithInterval sets how often the updates are gossiped.
+func WithInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.interval = d
+	}
+}
+
+// WithFanout sets how many random peers are picked in each round.
+func WithFanout(n int) Option {
+	return func(o *options) {
+		o.fanout = n
+	}
+}
+
+// WithRetransmitMult sets the multiplier of the retransmissions,
+// each update is gossiped for mult * log(N) rounds.
+func WithRetransmitMult(mult int) Option {
+	return func(o *options) {
+		o.retransmitMult = mult
+	}
+}
+
+// WithMaxUpdates sets how many updates a message carries at most.
+func WithMaxUpdates(n int) Option {
+	return func(o *options) {
+		o.maxUpdates = n
+	}
+}
+
+// WithSeenTTL sets how long the IDs of the delivered updates
+// are remembered to drop the duplicates.
+func WithSeenTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.seenTTL = d
+	}
+}
+
+// WithClock sets the clock, which is the system clock by default.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithLogger sets the logger, which writes to stderr by default.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
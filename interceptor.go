@@ -0,0 +1,70 @@
+package messenger
+
+// OutgoingMessage is a message on its way to the wire,
+// which is passed to the outbound interceptors.
+type OutgoingMessage struct {
+	// The address of the receiver, in the form of host:port.
+	To string
+	// The message to be marshalled.
+	Body interface{}
+	// The headers sent along with the message, nil if there is none.
+	Header Header
+
+	mts     *messageToSend
+	tracked bool // The result is reported by the reliable sender.
+}
+
+// OutboundHandler passes an outgoing message on,
+// it returns the error of sending the message.
+type OutboundHandler func(msg *OutgoingMessage) error
+
+// Interceptor intercepts the messages passing through the messenger.
+// Each hook is given the message and the next handler of the chain.
+// It can mutate the message, wrap the rest of the chain for logging
+// or timing, or short-circuit by not calling next. Either hook can be nil.
+type Interceptor struct {
+	// Inbound is called with each incoming message in the reading
+	// loop, before it's passed to the handler and the receive queue.
+	// The responses to Call() are intercepted in the incoming loop
+	// before they are passed to the caller, see Message.IsResponse().
+	Inbound func(msg *Message, next MessageHandler)
+	// Outbound is called with each outgoing message in the outgoing
+	// loop, before it's marshalled. The error is reported to the
+	// sender, e.g. the caller of SendContext(), and so is a panic,
+	// as a *PanicError. The acks are not intercepted.
+	Outbound func(msg *OutgoingMessage, next OutboundHandler) error
+}
+
+// Use appends the interceptor to the chains. The interceptors are
+// called in the order they are added, so the first one sees the
+// message first in both directions. It must be called before Start().
+func (m *Messenger) Use(i Interceptor) {
+	m.interceptors = append(m.interceptors, i)
+	m.inbound = chainInbound(m.interceptors, m.deliver)
+	m.inboundResp = chainInbound(m.interceptors, m.completeCall)
+	m.outbound = chainOutbound(m.interceptors, m.transmitMessage)
+}
+
+// Build the inbound chain that ends with the final handler.
+func chainInbound(interceptors []Interceptor, final MessageHandler) MessageHandler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if in := interceptors[i].Inbound; in != nil {
+			next := h
+			h = func(msg *Message) { in(msg, next) }
+		}
+	}
+	return h
+}
+
+// Build the outbound chain that ends with the final handler.
+func chainOutbound(interceptors []Interceptor, final OutboundHandler) OutboundHandler {
+	h := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if out := interceptors[i].Outbound; out != nil {
+			next := h
+			h = func(msg *OutgoingMessage) error { return out(msg, next) }
+		}
+	}
+	return h
+}
@@ -0,0 +1,31 @@
+// Package glogger adapts github.com/golang/glog to the logger.Logger.
+// It's in its own package so the binaries that don't use glog
+// don't get the glog flags.
+package glogger
+
+import (
+	"github.com/go-distributed/messenger/logger"
+	log "github.com/golang/glog"
+)
+
+// The verbosity level of the debug messages.
+const debugLevel = 2
+
+type glogLogger struct{}
+
+// New creates a logger that writes to glog.
+func New() logger.Logger {
+	return glogLogger{}
+}
+
+func (glogLogger) Debugf(format string, args ...interface{}) {
+	log.V(debugLevel).Infof(format, args...)
+}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	log.Infof(format, args...)
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	log.Warningf(format, args...)
+}
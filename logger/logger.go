@@ -0,0 +1,61 @@
+// Package logger defines the logging interface used by the messenger,
+// the codecs and the transporters, along with a few adapters.
+package logger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Logger is used to report what's happening.
+type Logger interface {
+	// Debugf logs the verbose messages.
+	Debugf(format string, args ...interface{})
+	// Infof logs the informational messages.
+	Infof(format string, args ...interface{})
+	// Warningf logs the errors that can be recovered from.
+	Warningf(format string, args ...interface{})
+}
+
+// The adapter of the standard log package.
+type stdLogger struct {
+	l       *log.Logger
+	verbose bool
+}
+
+// NewStdLogger creates a logger that writes to the standard logger.
+// If l is nil, it writes to stderr. The debug messages are only
+// written if verbose is true.
+func NewStdLogger(l *log.Logger, verbose bool) Logger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &stdLogger{l: l, verbose: verbose}
+}
+
+func (s *stdLogger) Debugf(format string, args ...interface{}) {
+	if s.verbose {
+		s.l.Output(2, "DEBUG: "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *stdLogger) Infof(format string, args ...interface{}) {
+	s.l.Output(2, "INFO: "+fmt.Sprintf(format, args...))
+}
+
+func (s *stdLogger) Warningf(format string, args ...interface{}) {
+	s.l.Output(2, "WARNING: "+fmt.Sprintf(format, args...))
+}
+
+// NewNopLogger creates a logger that discards everything.
+func NewNopLogger() Logger {
+	return NewStdLogger(log.New(ioutil.Discard, "", 0), false)
+}
+
+// Default returns the logger used when none is given,
+// which writes the informational messages and warnings to stderr.
+func Default() Logger {
+	return NewStdLogger(nil, false)
+}
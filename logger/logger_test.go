@@ -0,0 +1,32 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := NewStdLogger(log.New(&buf, "", 0), false)
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warningf("warning %d", 3)
+	assert.Equal(t, "INFO: info 2\nWARNING: warning 3\n", buf.String())
+
+	buf.Reset()
+	l = NewStdLogger(log.New(&buf, "", 0), true)
+	l.Debugf("debug %d", 1)
+	assert.Equal(t, "DEBUG: debug 1\n", buf.String())
+}
+
+func TestNopLogger(t *testing.T) {
+	l := NewNopLogger()
+	assert.NotNil(t, l)
+	l.Debugf("debug")
+	l.Infof("info")
+	l.Warningf("warning")
+}
@@ -0,0 +1,336 @@
+// Package membership keeps track of the live peers atop a messenger.
+// Every node sends heartbeats to the members it knows, a member that
+// stays silent is suspected after a timeout, and removed after a
+// longer one. The heartbeats carry the members of the sender, so a
+// node joining through a seed learns the whole group.
+package membership
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/logger"
+)
+
+// State is the state of a member.
+type State int
+
+const (
+	// StateAlive means the member is heard recently.
+	StateAlive State = iota
+	// StateSuspect means the member is silent for a while.
+	StateSuspect
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	}
+	return "unknown"
+}
+
+// Member is a peer in the group.
+type Member struct {
+	Addr     string
+	State    State
+	LastSeen time.Time
+}
+
+// EventType is the type of a membership event.
+type EventType int
+
+const (
+	// EventJoin is fired when a member is first heard.
+	EventJoin EventType = iota
+	// EventSuspect is fired when a member becomes suspected.
+	EventSuspect
+	// EventAlive is fired when a suspected member is heard again.
+	EventAlive
+	// EventLeave is fired when a member leaves the group,
+	// or is removed after the fail timeout.
+	EventLeave
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventSuspect:
+		return "suspect"
+	case EventAlive:
+		return "alive"
+	case EventLeave:
+		return "leave"
+	}
+	return "unknown"
+}
+
+// Event is a change of the membership.
+type Event struct {
+	Type   EventType
+	Member string
+}
+
+// EventHandler is a callback that handles the membership events.
+type EventHandler func(e Event)
+
+// Membership tracks the members of the group.
+type Membership struct {
+	m      *messenger.Messenger
+	clock  Clock
+	logger logger.Logger
+
+	heartbeatInterval time.Duration
+	suspectTimeout    time.Duration
+	failTimeout       time.Duration
+
+	mu       sync.Mutex
+	members  map[string]*Member
+	contacts map[string]time.Time // The peers to contact, and since when.
+	handlers []EventHandler
+	stop     chan struct{}
+	running  bool
+}
+
+// New creates a membership atop the messenger. It registers the
+// heartbeat to the messenger, so it must be called before the
+// messenger is started. The messenger should have the handlers enabled.
+func New(m *messenger.Messenger, opts ...Option) (*Membership, error) {
+	o := newOptions(opts)
+	ms := &Membership{
+		m:                 m,
+		clock:             o.clock,
+		logger:            o.logger,
+		heartbeatInterval: o.heartbeatInterval,
+		suspectTimeout:    o.suspectTimeout,
+		failTimeout:       o.failTimeout,
+		members:           make(map[string]*Member),
+		contacts:          make(map[string]time.Time),
+		stop:              make(chan struct{}),
+	}
+	if err := m.RegisterMessage(&Heartbeat{}); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterHandler(&Heartbeat{}, ms.handleHeartbeat); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// OnEvent adds a callback for the membership events.
+// The callbacks should return quickly.
+func (ms *Membership) OnEvent(h EventHandler) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.handlers = append(ms.handlers, h)
+}
+
+// Start sending the heartbeats and detecting the failures.
+// The heartbeats are ignored until it's started. It can be
+// started again after Stop() or Leave().
+func (ms *Membership) Start() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.running {
+		return
+	}
+	ms.running = true
+	ms.stop = make(chan struct{})
+	go ms.loop(ms.stop)
+}
+
+// Stop sending the heartbeats silently, the peers will
+// remove this node after the fail timeout.
+func (ms *Membership) Stop() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.running {
+		return
+	}
+	ms.running = false
+	close(ms.stop)
+}
+
+// Join contacts the seeds, the node joins the group once
+// any of the seeds replies.
+func (ms *Membership) Join(seeds ...string) {
+	now := ms.clock.Now()
+	ms.mu.Lock()
+	for _, seed := range seeds {
+		if _, ok := ms.members[seed]; !ok && seed != ms.m.Addr() {
+			ms.contacts[seed] = now
+		}
+	}
+	hb := ms.heartbeat()
+	ms.mu.Unlock()
+
+	ms.broadcast(seeds, hb)
+}
+
+// Leave tells the members that this node is leaving and stops.
+func (ms *Membership) Leave() {
+	ms.Stop()
+
+	ms.mu.Lock()
+	peers := ms.peers()
+	ms.members = make(map[string]*Member)
+	ms.contacts = make(map[string]time.Time)
+	ms.mu.Unlock()
+
+	ms.broadcast(peers, &Heartbeat{Leaving: proto.Bool(true)})
+}
+
+// Members returns the members of the group sorted by
+// the address, this node itself is not included.
+func (ms *Membership) Members() []Member {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	members := make([]Member, 0, len(ms.members))
+	for _, m := range ms.members {
+		members = append(members, *m)
+	}
+	sort.Sort(byAddr(members))
+	return members
+}
+
+type byAddr []Member
+
+func (b byAddr) Len() int           { return len(b) }
+func (b byAddr) Less(i, j int) bool { return b[i].Addr < b[j].Addr }
+func (b byAddr) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (ms *Membership) loop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ms.clock.After(ms.heartbeatInterval):
+			ms.tick()
+		}
+	}
+}
+
+// Detect the failures and send the heartbeats.
+func (ms *Membership) tick() {
+	now := ms.clock.Now()
+	var events []Event
+
+	ms.mu.Lock()
+	for addr, m := range ms.members {
+		silence := now.Sub(m.LastSeen)
+		switch {
+		case silence > ms.failTimeout:
+			delete(ms.members, addr)
+			events = append(events, Event{EventLeave, addr})
+		case silence > ms.suspectTimeout && m.State == StateAlive:
+			m.State = StateSuspect
+			events = append(events, Event{EventSuspect, addr})
+		}
+	}
+	for addr, since := range ms.contacts {
+		if now.Sub(since) > ms.failTimeout {
+			delete(ms.contacts, addr)
+		}
+	}
+	peers := ms.peers()
+	hb := ms.heartbeat()
+	handlers := ms.handlers
+	ms.mu.Unlock()
+
+	fire(handlers, events)
+	ms.broadcast(peers, hb)
+}
+
+func (ms *Membership) handleHeartbeat(msg *messenger.Message) {
+	hb := msg.Body.(*Heartbeat)
+	now := ms.clock.Now()
+	var events []Event
+
+	ms.mu.Lock()
+	if !ms.running {
+		// Ignore the peers once stopped or left.
+		ms.mu.Unlock()
+		return
+	}
+	delete(ms.contacts, msg.From)
+	m, ok := ms.members[msg.From]
+	switch {
+	case hb.GetLeaving():
+		if ok {
+			delete(ms.members, msg.From)
+			events = append(events, Event{EventLeave, msg.From})
+		}
+	case !ok:
+		ms.members[msg.From] = &Member{Addr: msg.From, State: StateAlive, LastSeen: now}
+		events = append(events, Event{EventJoin, msg.From})
+	default:
+		if m.State == StateSuspect {
+			m.State = StateAlive
+			events = append(events, Event{EventAlive, msg.From})
+		}
+		m.LastSeen = now
+	}
+	if !hb.GetLeaving() {
+		// Only the direct heartbeats make a member, the others
+		// are contacted until they reply or the fail timeout.
+		for _, addr := range hb.GetMembers() {
+			if _, ok := ms.members[addr]; ok || addr == ms.m.Addr() {
+				continue
+			}
+			if _, ok := ms.contacts[addr]; !ok {
+				ms.contacts[addr] = now
+			}
+		}
+	}
+	handlers := ms.handlers
+	ms.mu.Unlock()
+
+	fire(handlers, events)
+}
+
+// The heartbeat to send, the caller must hold the lock.
+func (ms *Membership) heartbeat() *Heartbeat {
+	hb := &Heartbeat{}
+	for addr, m := range ms.members {
+		if m.State == StateAlive {
+			hb.Members = append(hb.Members, addr)
+		}
+	}
+	sort.Strings(hb.Members)
+	return hb
+}
+
+// The members and the contacts, the caller must hold the lock.
+func (ms *Membership) peers() []string {
+	peers := make([]string, 0, len(ms.members)+len(ms.contacts))
+	for addr := range ms.members {
+		peers = append(peers, addr)
+	}
+	for addr := range ms.contacts {
+		peers = append(peers, addr)
+	}
+	return peers
+}
+
+func (ms *Membership) broadcast(peers []string, hb *Heartbeat) {
+	for _, peer := range peers {
+		if err := ms.m.Send(peer, hb); err != nil {
+			ms.logger.Warningf("Membership: Failed to send heartbeat to %v: %v\n", peer, err)
+		}
+	}
+}
+
+func fire(handlers []EventHandler, events []Event) {
+	for _, e := range events {
+		for _, h := range handlers {
+			h(e)
+		}
+	}
+}
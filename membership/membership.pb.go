@@ -0,0 +1,41 @@
+// Code generated by protoc-gen-gogo.
+// source: membership.proto
+// DO NOT EDIT!
+
+package membership
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type Heartbeat struct {
+	Members          []string `protobuf:"bytes,1,rep,name=members" json:"members,omitempty"`
+	Leaving          *bool    `protobuf:"varint,2,opt,name=leaving" json:"leaving,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Heartbeat) Reset()         { *m = Heartbeat{} }
+func (m *Heartbeat) String() string { return proto.CompactTextString(m) }
+func (*Heartbeat) ProtoMessage()    {}
+
+func (m *Heartbeat) GetMembers() []string {
+	if m != nil {
+		return m.Members
+	}
+	return nil
+}
+
+func (m *Heartbeat) GetLeaving() bool {
+	if m != nil && m.Leaving != nil {
+		return *m.Leaving
+	}
+	return false
+}
+
+func init() {
+}
@@ -0,0 +1,163 @@
+package membership
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+const interval = time.Second
+
+// Collect the events fired by a membership.
+type eventRecorder struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(e Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) has(e Event) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, event := range r.events {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+type node struct {
+	m        *messenger.Messenger
+	ms       *Membership
+	recorder *eventRecorder
+}
+
+func newNode(t *testing.T, network *transporter.MemoryNetwork, clock Clock, hostport string) *node {
+	m := messenger.New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, hostport), false, true)
+	assert.NotNil(t, m)
+	ms, err := New(m, WithClock(clock), WithHeartbeatInterval(interval), WithTimeouts(interval*3, interval*6))
+	assert.NoError(t, err)
+	r := &eventRecorder{}
+	ms.OnEvent(r.handle)
+	assert.NoError(t, m.Start())
+	ms.Start()
+	return &node{m, ms, r}
+}
+
+func addrs(members []Member) []string {
+	var result []string
+	for _, m := range members {
+		result = append(result, m.Addr)
+	}
+	return result
+}
+
+// Advance the clock by one interval once all the loops are
+// waiting, until the condition is true.
+func advanceUntil(t *testing.T, clock *FakeClock, loops int, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		deadline := time.Now().Add(time.Second)
+		for clock.Waiters() < loops {
+			if time.Now().After(deadline) {
+				t.Fatalf("Only %d of the %d loops are running", clock.Waiters(), loops)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(interval)
+		// Let the heartbeats arrive.
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("Condition is not met after 100 intervals")
+}
+
+func TestMembership(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	clock := NewFakeClock(time.Now())
+	a := newNode(t, network, clock, "a")
+	b := newNode(t, network, clock, "b")
+	c := newNode(t, network, clock, "c")
+
+	// Should learn the whole group through the seeds.
+	b.ms.Join("a")
+	c.ms.Join("b")
+	advanceUntil(t, clock, 3, func() bool {
+		return len(a.ms.Members()) == 2 && len(b.ms.Members()) == 2 && len(c.ms.Members()) == 2
+	})
+	assert.Equal(t, []string{"b", "c"}, addrs(a.ms.Members()))
+	assert.Equal(t, []string{"a", "c"}, addrs(b.ms.Members()))
+	assert.Equal(t, []string{"a", "b"}, addrs(c.ms.Members()))
+	assert.True(t, a.recorder.has(Event{EventJoin, "c"}))
+
+	// Should suspect and then remove a silent member.
+	c.ms.Stop()
+	advanceUntil(t, clock, 2, func() bool {
+		return a.recorder.has(Event{EventSuspect, "c"}) && b.recorder.has(Event{EventSuspect, "c"})
+	})
+	for _, m := range a.ms.Members() {
+		if m.Addr == "c" {
+			assert.Equal(t, StateSuspect, m.State)
+		}
+	}
+	advanceUntil(t, clock, 2, func() bool {
+		return a.recorder.has(Event{EventLeave, "c"}) && b.recorder.has(Event{EventLeave, "c"})
+	})
+	assert.Equal(t, []string{"b"}, addrs(a.ms.Members()))
+	assert.Equal(t, []string{"a"}, addrs(b.ms.Members()))
+
+	// Should keep sending the heartbeats once restarted.
+	c.ms.Start()
+	c.ms.Join("a")
+	rounds := 0
+	advanceUntil(t, clock, 3, func() bool {
+		rounds++
+		return rounds > 8
+	})
+	assert.Equal(t, []string{"b", "c"}, addrs(a.ms.Members()))
+
+	// Should be removed at once if it leaves.
+	b.ms.Leave()
+	advanceUntil(t, clock, 2, func() bool {
+		return a.recorder.has(Event{EventLeave, "b"})
+	})
+	assert.Equal(t, []string{"c"}, addrs(a.ms.Members()))
+
+	a.ms.Stop()
+	c.ms.Stop()
+	assert.NoError(t, a.m.Stop())
+	assert.NoError(t, b.m.Stop())
+	assert.NoError(t, c.m.Stop())
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	clock := NewFakeClock(start)
+	c1 := clock.After(time.Second)
+	c2 := clock.After(time.Second * 2)
+	assert.Equal(t, 2, clock.Waiters())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-c1)
+	assert.Equal(t, 1, clock.Waiters())
+	select {
+	case <-c2:
+		t.Fatal("Timer fired too early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second*2), <-c2)
+	assert.Equal(t, start.Add(time.Second*2), clock.Now())
+}
@@ -0,0 +1,74 @@
+package membership
+
+import (
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// The default settings of the failure detector.
+const (
+	defaultHeartbeatInterval = time.Second
+	defaultSuspectTimeout    = time.Second * 3
+	defaultFailTimeout       = time.Second * 10
+)
+
+// The configurable settings of a membership.
+type options struct {
+	heartbeatInterval time.Duration
+	suspectTimeout    time.Duration
+	failTimeout       time.Duration
+	clock             Clock
+	logger            logger.Logger
+}
+
+func defaultOptions() *options {
+	return &options{
+		heartbeatInterval: defaultHeartbeatInterval,
+		suspectTimeout:    defaultSuspectTimeout,
+		failTimeout:       defaultFailTimeout,
+		clock:             realClock{},
+		logger:            logger.Default(),
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Option configures a membership, see New().
+type Option func(*options)
+
+// WithHeartbeatInterval sets how often the heartbeats are sent.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.heartbeatInterval = d
+	}
+}
+
+// WithTimeouts sets how long a silent member is suspected,
+// and how long it's removed from the group.
+func WithTimeouts(suspect, fail time.Duration) Option {
+	return func(o *options) {
+		o.suspectTimeout = suspect
+		o.failTimeout = fail
+	}
+}
+
+// WithClock sets the clock, which is the system clock by default.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithLogger sets the logger, which writes to stderr by default.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
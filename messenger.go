@@ -1,26 +1,92 @@
 package messenger
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/logger"
 	"github.com/go-distributed/messenger/transporter"
-	log "github.com/golang/glog"
 )
 
 const defaultQueueSize = 1024
-const preparePeriod = time.Second * 1
+
+// ErrStopped is returned by Send() and Call() if the messenger
+// is stopped before the message is queued or the response arrives.
+var ErrStopped = errors.New("Messenger is stopped")
 
 // MessageHandler is a callback that handles the messages.
 // One can register the message with the callback by
 // calling RegisterHandler.
-type MessageHandler func(interface{})
+type MessageHandler func(msg *Message)
+
+// Message is a received message that is passed to the handlers.
+type Message struct {
+	// The decoded message.
+	Body interface{}
+	// The address of the sender, which is the address the
+	// sender listens on, in the form of host:port.
+	From string
+	// The identity of the sender verified by the transporter,
+	// nil if the transporter doesn't authenticate the peers.
+	Peer *transporter.PeerInfo
+	// The headers set by the sender, nil if there is none.
+	Header Header
+
+	m    *Messenger
+	kind envelopeKind
+	id   uint64 // Correlation ID of a request or response.
+	raw  []byte // The envelope received from the wire.
+}
+
+// IsRequest returns true if the message is a request sent by Call(),
+// which expects a Reply().
+func (msg *Message) IsRequest() bool {
+	return msg.kind == kindRequest
+}
+
+// IsResponse returns true if the message is a response to a Call(),
+// which is only seen by the inbound interceptors.
+func (msg *Message) IsResponse() bool {
+	return msg.kind == kindResponse
+}
+
+// Reply sends a response back to the caller of the request.
+// The response should be a registered message as well.
+func (msg *Message) Reply(resp interface{}) error {
+	if !msg.IsRequest() {
+		return fmt.Errorf("Cannot reply to a message that is not a request")
+	}
+	return msg.m.send(context.Background(), &messageToSend{
+		hostport: msg.From,
+		msg:      resp,
+		kind:     kindResponse,
+		id:       msg.id,
+	})
+}
 
 type messageToSend struct {
 	hostport string
 	msg      interface{}
+	kind     envelopeKind
+	id       uint64
+	result   chan error
+	header   Header
+	epoch    uint64 // Only used by acks.
+	seq      uint64 // Only used by acks.
+}
+
+// Report the result of sending the message, if anyone is waiting.
+func (mts *messageToSend) done(err error) {
+	if mts.result != nil {
+		mts.result <- err
+	}
 }
 
 // Messenger is an abstraction that can send and receive
@@ -28,15 +94,41 @@ type messageToSend struct {
 type Messenger struct {
 	codec     codec.Codec
 	tr        transporter.Transporter
-	inQueue   chan interface{}    // For incomming messages.
+	inQueue   chan *Message       // For incomming messages.
 	outQueue  chan *messageToSend // For outgoing messages.
-	recvQueue chan interface{}    // Buffer for recv messages.
+	ackQueue  chan *messageToSend // For acks, which are dropped if it's full.
+	recvQueue chan *Message       // Buffer for recv messages.
 
 	handlers           map[reflect.Type]MessageHandler
 	registeredMessages map[reflect.Type]bool
 	stop               chan struct{}
+	sendLock           sync.RWMutex // Held by the senders while queueing.
 	enableRecv         bool
 	enableHandler      bool
+
+	lastCallID   uint64 // Accessed atomically, starts from a random ID.
+	busy         int64  // Accessed atomically, the messages being received, handled or sent.
+	callsLock    sync.Mutex
+	pendingCalls map[uint64]*pendingCall
+
+	sender   *reliableSender // Nil if the reliable delivery is disabled.
+	receiver *reliableReceiver
+
+	dispatcher *dispatcher
+
+	interceptors []Interceptor
+	inbound      MessageHandler  // The inbound chain.
+	inboundResp  MessageHandler  // The inbound chain of the responses.
+	outbound     OutboundHandler // The outbound chain.
+
+	logger       logger.Logger
+	clock        Clock
+	newID        func() uint64
+	stats        *stats
+	queuePolicy  QueuePolicy
+	startTimeout time.Duration
+	errorHook    func(err error)
+	deadLetters  []DeadLetterSink
 }
 
 // New create a new messenger.
@@ -44,25 +136,70 @@ type Messenger struct {
 // responsible to consume the message via Recv(), otherwise
 // the the underlying reading will stop if the queue is full.
 // At least one of the enableRecv and enableHandler should be
-// set to true.
+// set to true. The options tune the messenger, the defaults are
+// used if no options are given.
 func New(codec codec.Codec, tr transporter.Transporter,
-	enableRecv, enableHandler bool) *Messenger {
+	enableRecv, enableHandler bool, opts ...Option) *Messenger {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	if !enableRecv && !enableHandler {
-		log.Warningf("Neither recv or handler is enabled\n")
+		o.logger.Warningf("Neither recv or handler is enabled\n")
 		return nil
 	}
-	return &Messenger{
+	m := &Messenger{
 		codec:              codec,
 		tr:                 tr,
-		inQueue:            make(chan interface{}, defaultQueueSize),
-		outQueue:           make(chan *messageToSend, defaultQueueSize),
-		recvQueue:          make(chan interface{}, defaultQueueSize),
+		inQueue:            make(chan *Message, o.inQueueSize),
+		outQueue:           make(chan *messageToSend, o.outQueueSize),
+		ackQueue:           make(chan *messageToSend, o.outQueueSize),
+		recvQueue:          make(chan *Message, o.recvQueueSize),
 		handlers:           make(map[reflect.Type]MessageHandler),
 		registeredMessages: make(map[reflect.Type]bool),
 		stop:               make(chan struct{}),
 		enableRecv:         enableRecv,
 		enableHandler:      enableHandler,
+		lastCallID:         o.idSource(),
+		pendingCalls:       make(map[uint64]*pendingCall),
+		receiver:           newReliableReceiver(),
+		logger:             o.logger,
+		clock:              o.clock,
+		newID:              o.idSource,
+		stats:              newStats(o.metrics),
+		queuePolicy:        o.queuePolicy,
+		startTimeout:       o.startTimeout,
+		errorHook:          o.errorHook,
+		deadLetters:        o.deadLetters,
+	}
+	m.inbound = m.deliver
+	m.inboundResp = m.completeCall
+	m.outbound = m.transmitMessage
+	m.SetDispatcher(o.dispatchMode, o.workers)
+	if o.reliable {
+		m.EnableReliable(o.deadline)
 	}
+	return m
+}
+
+// SetDispatcher sets how the messages are passed to the handlers.
+// By default the handlers are invoked one by one in the reading loop.
+// Other modes run the handlers on a pool of workers, the number of
+// workers is set to a default value if it's not positive.
+// It must be called before Start().
+func (m *Messenger) SetDispatcher(mode DispatchMode, workers int) {
+	m.dispatcher = newDispatcher(mode, workers, m.invokeHandler)
+}
+
+// EnableReliable turns on the at-least-once delivery for the messages
+// sent by this messenger. Each message is retransmitted with exponential
+// backoff until the receiver acknowledges it, or the deadline passes.
+// The receiver drops the duplicates, so the handlers see each message once.
+// Peers must be addressed by the address they listen on for the
+// acknowledgements to match. It must be called before Start().
+func (m *Messenger) EnableReliable(deadline time.Duration) {
+	m.sender = newReliableSender(deadline, m.newID(), m.clock, m.logger)
 }
 
 // RegisterMessage Regists a message in the messenger.
@@ -79,6 +216,49 @@ func (m *Messenger) RegisterMessage(msg interface{}) error {
 	return nil
 }
 
+// RegisterMessageWithID regists a message with an explicit ID, so the
+// nodes agree on the IDs no matter in which order they register the
+// messages. The codec must implement codec.IDRegisterer.
+func (m *Messenger) RegisterMessageWithID(id uint32, msg interface{}) error {
+	msgType := reflect.TypeOf(msg)
+	if _, ok := m.registeredMessages[msgType]; ok {
+		return fmt.Errorf("Message type %v already registered", msgType)
+	}
+	r, ok := m.codec.(codec.IDRegisterer)
+	if !ok {
+		return fmt.Errorf("Codec %T cannot register explicit message IDs", m.codec)
+	}
+	if err := r.RegisterMessageWithID(id, msg); err != nil {
+		return err
+	}
+	m.registeredMessages[msgType] = true
+	return nil
+}
+
+// Marshal encodes a registered message by the codec of the messenger,
+// so it can be carried in another message, e.g. by the pubsub.
+func (m *Messenger) Marshal(msg interface{}) ([]byte, error) {
+	msgType := reflect.TypeOf(msg)
+	if _, ok := m.registeredMessages[msgType]; !ok {
+		return nil, fmt.Errorf("Unregistered message type: %v", msgType)
+	}
+	return m.codec.Marshal(msg)
+}
+
+// Unmarshal decodes a message encoded by Marshal(),
+// the message must be registered in the messenger.
+func (m *Messenger) Unmarshal(b []byte) (interface{}, error) {
+	msg, err := m.codec.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	msgType := reflect.TypeOf(msg)
+	if _, ok := m.registeredMessages[msgType]; !ok {
+		return nil, fmt.Errorf("Unregistered message type: %v", msgType)
+	}
+	return msg, nil
+}
+
 // RegisterHandler regists a message with a handler.
 // When such a message comes in, it will be passed to
 // the handler.
@@ -95,29 +275,141 @@ func (m *Messenger) RegisterHandler(msg interface{}, msgHandler MessageHandler)
 	return nil
 }
 
+// Addr returns the address the messenger listens on.
+func (m *Messenger) Addr() string {
+	return m.tr.Addr()
+}
+
 // Start the messenger.
 func (m *Messenger) Start() error {
 	if err := m.codec.Initial(); err != nil {
 		return err
 	}
 
-	errChan := make(chan error)
+	// Return as soon as the transporter is ready.
+	if err := m.listen(); err != nil {
+		return err
+	}
 	go func() {
-		if err := m.tr.Start(); err != nil {
-			errChan <- err
+		if err := m.tr.Serve(); err != nil {
+			m.logger.Warningf("Transporter Serve() error: %v\n", err)
 		}
 	}()
 
+	m.dispatcher.start(m.stop)
+	go m.incomingLoop()
+	go m.outgoingLoop()
+	go m.readingLoop()
+	if m.sender != nil {
+		m.clock.AfterFunc(retransmitTick, m.retransmit)
+	}
+	return nil
+}
+
+// Bind the transporter, give up after the start timeout.
+func (m *Messenger) listen() error {
+	if m.startTimeout <= 0 {
+		return m.tr.Listen()
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- m.tr.Listen()
+	}()
+
 	select {
 	case err := <-errChan:
 		return err
-	case <-time.After(preparePeriod):
+	case <-time.After(m.startTimeout):
+		return fmt.Errorf("Transporter is not ready after %v", m.startTimeout)
 	}
+}
 
-	go m.incomingLoop()
-	go m.outgoingLoop()
-	go m.readingLoop()
-	return nil
+// Put the incoming message into the queue according to the queue policy,
+// return false if it's dropped.
+func (m *Messenger) enqueue(queue chan *Message, msg *Message) bool {
+	if m.queuePolicy == QueueDrop {
+		select {
+		case queue <- msg:
+			return true
+		default:
+			m.logger.Warningf("Queue is full, dropped %v from %v\n", reflect.TypeOf(msg.Body), msg.From)
+			m.stats.recordDropped()
+			return false
+		}
+	}
+
+	select {
+	case queue <- msg:
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+// Count the messages being received, handled or sent, see Idle().
+func (m *Messenger) working(delta int64) {
+	atomic.AddInt64(&m.busy, delta)
+}
+
+// Idle returns true if the messenger is not receiving, handling or
+// sending any message, or it's stopped, so a simulation can tell when
+// the messenger is done reacting to a message. The messages waiting
+// for Recv() are not counted, neither are the ones dispatched to
+// the handlers by the inbound interceptors on their own.
+func (m *Messenger) Idle() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+	}
+	return atomic.LoadInt64(&m.busy) == 0
+}
+
+// Invoke the handler and record its latency.
+// A panic of the handler is recovered and reported.
+func (m *Messenger) invokeHandler(msg *Message, h MessageHandler) {
+	start := time.Now()
+	defer m.working(-1)
+	defer func() {
+		if v := recover(); v != nil {
+			m.handlePanic(msg, v, debug.Stack())
+		}
+		m.stats.recordLatency(typeName(msg.Body), time.Since(start))
+	}()
+	h(msg)
+}
+
+// Pass the message to the inbound chain, a panic of the
+// interceptors is reported like the one of a handler.
+func (m *Messenger) runInbound(chain MessageHandler, msg *Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			m.handlePanic(msg, v, debug.Stack())
+		}
+	}()
+	chain(msg)
+}
+
+// Pass the message to the outbound chain, a panic of the
+// interceptors is reported and returned as the error.
+func (m *Messenger) runOutbound(out *OutgoingMessage) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = m.handleOutgoingPanic(out.mts, v, debug.Stack())
+		}
+	}()
+	return m.outbound(out)
+}
+
+// Receive from the transporter, along with the identity
+// of the peer if the transporter can tell.
+func (m *Messenger) recvFrom() (string, []byte, *transporter.PeerInfo, error) {
+	if r, ok := m.tr.(transporter.PeerReceiver); ok {
+		return r.RecvFromPeer()
+	}
+	from, b, err := m.tr.RecvFrom()
+	return from, b, nil, err
 }
 
 // From the wire to the queue.
@@ -129,18 +421,76 @@ func (m *Messenger) incomingLoop() {
 		default:
 		}
 
-		b, err := m.tr.Recv()
+		from, b, peer, err := m.recvFrom()
+		if err == transporter.ErrStopped {
+			return
+		}
 		if err != nil {
-			log.Warningf("Transporter Recv() error: %v\n", err)
+			m.logger.Warningf("Transporter Recv() error: %v\n", err)
 			continue
 		}
-		msg, err := m.codec.Unmarshal(b)
+		e, err := unmarshalEnvelope(b)
 		if err != nil {
-			log.Warningf("Codec Unmarshal() error: %v\n", err)
+			m.logger.Warningf("Failed to unmarshal envelope: %v\n", err)
+			m.stats.recordUnmarshalError()
+			m.deadLetter(&DeadLetter{Reason: DeadLetterUnmarshal, Addr: from, Peer: peer, Data: b, Err: err})
+			continue
+		}
+		if e.kind == kindAck {
+			if m.sender != nil {
+				m.sender.ack(from, e.epoch, e.seq)
+			}
 			continue
 		}
-		m.inQueue <- msg
+		if e.seq != 0 {
+			// Always ack, in case the previous ack is lost.
+			m.sendAck(from, e.epoch, e.seq)
+			if m.receiver.isDuplicate(from, e.epoch, e.seq) {
+				m.logger.Debugf("Duplicated message %d from %v\n", e.seq, from)
+				continue
+			}
+		}
+		if err := m.receive(from, peer, b, e); err != nil {
+			m.logger.Warningf("Codec Unmarshal() error: %v\n", err)
+			m.stats.recordUnmarshalError()
+			m.deadLetter(&DeadLetter{Reason: DeadLetterUnmarshal, Addr: from, Peer: peer, Data: b, Err: err})
+		}
+	}
+}
+
+// Queue the ack of a reliable message, it never blocks the incoming
+// loop, otherwise two peers with full outgoing queues could wait for
+// each other. A dropped ack is fine, the sender will retransmit the message.
+func (m *Messenger) sendAck(hostport string, epoch, seq uint64) {
+	m.working(1)
+	select {
+	case m.ackQueue <- &messageToSend{hostport: hostport, kind: kindAck, epoch: epoch, seq: seq}:
+	default:
+		m.working(-1)
+		m.logger.Debugf("Queue is full, dropped ack %d to %v\n", seq, hostport)
+		m.stats.recordDropped()
+	}
+}
+
+// Decode the message in the envelope received from the peer,
+// and pass it to the pending call or the queue.
+func (m *Messenger) receive(from string, peer *transporter.PeerInfo, data []byte, e *envelope) error {
+	msg, err := m.codec.Unmarshal(e.payload)
+	if err != nil {
+		return err
+	}
+	m.stats.recordReceived(reflect.TypeOf(msg).String())
+	in := &Message{Body: msg, From: from, Peer: peer, Header: e.header, m: m, kind: e.kind, id: e.id, raw: data}
+	if e.kind == kindResponse {
+		// Not queued, so a handler can wait for a Call().
+		m.runInbound(m.inboundResp, in)
+		return nil
+	}
+	m.working(1)
+	if !m.enqueue(m.inQueue, in) {
+		m.working(-1)
 	}
+	return nil
 }
 
 // From the queue to callbacks / recvQueue.
@@ -150,24 +500,39 @@ func (m *Messenger) readingLoop() {
 		case <-m.stop:
 			return
 		case msg := <-m.inQueue:
-			msgType := reflect.TypeOf(msg)
+			m.stats.setGauge(MetricInQueueDepth, len(m.inQueue))
+			msgType := reflect.TypeOf(msg.Body)
 			// Verify message type.
 			if _, ok := m.registeredMessages[msgType]; !ok {
-				log.Warningf("Unregistered message type: %v\n", msgType)
+				m.logger.Warningf("Unregistered message type: %v\n", msgType)
+				m.rejectMessage(DeadLetterUnregistered, msg, fmt.Errorf("Unregistered message type: %v", msgType))
+				m.working(-1)
 				continue
 			}
-			// Pass the message to the handler.
-			if m.enableHandler {
-				if h, ok := m.handlers[msgType]; ok {
-					h(msg)
-				}
-			}
-			// Pass the message to the receive queue.
-			if m.enableRecv {
-				m.recvQueue <- msg
-			}
+			m.runInbound(m.inbound, msg)
+			m.working(-1)
+		}
+	}
+}
+
+// Pass the message to the handler and the receive queue,
+// which is the end of the inbound chain.
+func (m *Messenger) deliver(msg *Message) {
+	handled := false
+	if m.enableHandler {
+		if h, ok := m.handlers[reflect.TypeOf(msg.Body)]; ok {
+			m.working(1)
+			m.dispatcher.dispatch(msg, h, m.stop)
+			handled = true
 		}
 	}
+	if m.enableRecv {
+		m.enqueue(m.recvQueue, msg)
+		return
+	}
+	if !handled {
+		m.rejectMessage(DeadLetterNoHandler, msg, fmt.Errorf("No handler for message type: %T", msg.Body))
+	}
 }
 
 // From the queue to the wire.
@@ -175,23 +540,134 @@ func (m *Messenger) outgoingLoop() {
 	for {
 		select {
 		case <-m.stop:
+			m.drain()
 			return
+		case ack := <-m.ackQueue:
+			m.transmitAck(ack)
 		case mts := <-m.outQueue:
-			// TODO: Verify message type.
-			b, err := m.codec.Marshal(mts.msg)
-			if err != nil {
-				log.Warningf("Codec Marshal() error: %v\n", err)
-				continue
+			// The acks queued before the message go first,
+			// so the order doesn't depend on the scheduling.
+			m.transmitAcks()
+			m.stats.setGauge(MetricOutQueueDepth, len(m.outQueue))
+			out := &OutgoingMessage{To: mts.hostport, Body: mts.msg, Header: mts.header, mts: mts}
+			err := m.runOutbound(out)
+			if !out.tracked {
+				mts.done(err)
 			}
+			m.working(-1)
+		}
+	}
+}
 
-			if err = m.tr.Send(mts.hostport, b); err != nil {
-				log.Warningf("Transporter Send() error: %v\n", err)
-				continue
+// Send the queued acks.
+func (m *Messenger) transmitAcks() {
+	for {
+		select {
+		case ack := <-m.ackQueue:
+			m.transmitAck(ack)
+		default:
+			return
+		}
+	}
+}
+
+func (m *Messenger) transmitAck(ack *messageToSend) {
+	e := &envelope{kind: kindAck, epoch: ack.epoch, seq: ack.seq}
+	m.transmit(ack.hostport, e.marshal())
+	m.working(-1)
+}
+
+// Report ErrStopped for the messages that are still queued or
+// waiting for the acks, once no more messages can be queued.
+func (m *Messenger) drain() {
+	// Wait for the senders that have seen the messenger running.
+	m.sendLock.Lock()
+	m.sendLock.Unlock()
+
+	for {
+		select {
+		case mts := <-m.outQueue:
+			mts.done(ErrStopped)
+		default:
+			if m.sender != nil {
+				for _, u := range m.sender.abandon() {
+					u.mts.done(ErrStopped)
+				}
 			}
+			return
 		}
 	}
 }
 
+// Marshal the message and send it, which is the end of the outbound chain.
+func (m *Messenger) transmitMessage(out *OutgoingMessage) error {
+	mts := out.mts
+	mts.hostport, mts.msg, mts.header = out.To, out.Body, out.Header
+
+	// TODO: Verify message type.
+	if mts.msg == nil {
+		err := fmt.Errorf("Cannot send a nil message")
+		m.rejectOutgoing(DeadLetterMarshal, mts, nil, err)
+		return err
+	}
+	b, err := m.codec.Marshal(mts.msg)
+	if err != nil {
+		m.logger.Warningf("Codec Marshal() error: %v\n", err)
+		m.stats.recordMarshalError()
+		m.rejectOutgoing(DeadLetterMarshal, mts, nil, err)
+		return err
+	}
+
+	e := &envelope{kind: mts.kind, id: mts.id, header: mts.header, payload: b}
+	if m.sender != nil {
+		// Will be retransmitted if the Send() fails, and the
+		// result is reported once it's acknowledged or expired.
+		out.tracked = true
+		data := m.sender.track(mts, e)
+		if m.transmit(mts.hostport, data) == nil {
+			m.stats.recordSent(reflect.TypeOf(mts.msg).String())
+		}
+		return nil
+	}
+	data := e.marshal()
+	if err := m.transmit(mts.hostport, data); err != nil {
+		m.rejectOutgoing(DeadLetterSendFailed, mts, data, err)
+		return err
+	}
+	m.stats.recordSent(reflect.TypeOf(mts.msg).String())
+	return nil
+}
+
+// Send the bytes by the transporter and record the result.
+func (m *Messenger) transmit(hostport string, data []byte) error {
+	if err := m.tr.Send(hostport, data); err != nil {
+		m.logger.Warningf("Transporter Send() error: %v\n", err)
+		m.stats.recordTransportError()
+		return err
+	}
+	return nil
+}
+
+// Retransmit the unacknowledged messages, and check
+// again after a tick until the messenger is stopped.
+func (m *Messenger) retransmit() {
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+
+	resend, expired := m.sender.due(m.clock.Now())
+	for _, u := range resend {
+		m.logger.Debugf("Retransmitting message %d to %v\n", u.key.seq, u.key.hostport)
+		m.transmit(u.key.hostport, u.data)
+	}
+	for _, u := range expired {
+		m.rejectOutgoing(DeadLetterSendFailed, u.mts, u.data, ErrNotAcknowledged)
+	}
+	m.clock.AfterFunc(retransmitTick, m.retransmit)
+}
+
 // Stop the messenger.
 func (m *Messenger) Stop() error {
 	close(m.stop)
@@ -199,24 +675,190 @@ func (m *Messenger) Stop() error {
 }
 
 // Send a message.
+// This will block if the outgoing queue is full.
 func (m *Messenger) Send(hostport string, msg interface{}) error {
-	// Verify the message.
-	msgType := reflect.TypeOf(msg)
+	return m.send(context.Background(), &messageToSend{hostport: hostport, msg: msg, kind: kindMessage})
+}
+
+// SendContext sends a message and returns a channel that reports
+// the result of marshaling and sending it by the transporter. In the
+// reliable mode, the result is reported once the message is acknowledged,
+// or ErrNotAcknowledged is reported after the deadline.
+// The ctx is respected while waiting for room in the outgoing queue.
+// ErrStopped is reported if the messenger is stopped before the message
+// is sent, or acknowledged in the reliable mode.
+func (m *Messenger) SendContext(ctx context.Context, hostport string, msg interface{}) (<-chan error, error) {
+	result := make(chan error, 1)
+	if err := m.send(ctx, &messageToSend{
+		hostport: hostport,
+		msg:      msg,
+		kind:     kindMessage,
+		result:   result,
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SendWithHeader sends a message along with the headers,
+// which are passed to the handler of the receiver.
+func (m *Messenger) SendWithHeader(hostport string, msg interface{}, header Header) error {
+	return m.send(context.Background(), &messageToSend{
+		hostport: hostport,
+		msg:      msg,
+		kind:     kindMessage,
+		header:   header,
+	})
+}
+
+type headerKey struct{}
+
+// ContextWithHeader returns a context carrying the headers, which
+// are sent along with the message by SendContext() and Call().
+func ContextWithHeader(ctx context.Context, header Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, header)
+}
+
+// Verify the message and put it into the outgoing queue.
+func (m *Messenger) send(ctx context.Context, mts *messageToSend) error {
+	msgType := reflect.TypeOf(mts.msg)
 	if _, ok := m.registeredMessages[msgType]; !ok {
 		return fmt.Errorf("Unregistered message type: %v\n", msgType)
 	}
+	if mts.header == nil {
+		mts.header, _ = ctx.Value(headerKey{}).(Header)
+	}
 
-	m.outQueue <- &messageToSend{hostport, msg}
+	m.working(1)
+	if err := m.queue(ctx, mts); err != nil {
+		m.working(-1)
+		return err
+	}
 	return nil
 }
 
+// Put the message into the outgoing queue according to the queue policy.
+func (m *Messenger) queue(ctx context.Context, mts *messageToSend) error {
+	m.sendLock.RLock()
+	defer m.sendLock.RUnlock()
+	select {
+	case <-m.stop:
+		return ErrStopped
+	default:
+	}
+
+	if m.queuePolicy == QueueDrop {
+		select {
+		case m.outQueue <- mts:
+			return nil
+		case <-m.stop:
+			return ErrStopped
+		default:
+			m.stats.recordDropped()
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case m.outQueue <- mts:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.stop:
+		return ErrStopped
+	}
+}
+
+// Call sends a request to the host:port and waits for the response,
+// which is sent by the handler on the peer via Message.Reply().
+// The peer must be addressed by the address it listens on, the
+// responses from any other address are dropped.
+// The timeout of the call is controlled by the ctx. It returns
+// at once if the request cannot be marshalled or sent.
+func (m *Messenger) Call(ctx context.Context, hostport string, req interface{}) (interface{}, error) {
+	id := atomic.AddUint64(&m.lastCallID, 1)
+	respChan := make(chan interface{}, 1)
+
+	m.callsLock.Lock()
+	m.pendingCalls[id] = &pendingCall{hostport: hostport, resp: respChan}
+	m.callsLock.Unlock()
+
+	defer func() {
+		m.callsLock.Lock()
+		delete(m.pendingCalls, id)
+		m.callsLock.Unlock()
+	}()
+
+	result := make(chan error, 1)
+	if err := m.send(ctx, &messageToSend{
+		hostport: hostport,
+		msg:      req,
+		kind:     kindRequest,
+		id:       id,
+		result:   result,
+	}); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case resp := <-respChan:
+			return resp, nil
+		case err := <-result:
+			// Don't wait for the response if the request is not sent.
+			if err != nil {
+				return nil, err
+			}
+			result = nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.stop:
+			return nil, ErrStopped
+		}
+	}
+}
+
+// A call waiting for the response.
+type pendingCall struct {
+	hostport string // Where the request is sent.
+	resp     chan interface{}
+}
+
+// Pass the response to the pending call, which is the end of the
+// inbound chain of the responses. The response must come from the
+// peer the request is sent to.
+func (m *Messenger) completeCall(msg *Message) {
+	m.callsLock.Lock()
+	call, ok := m.pendingCalls[msg.id]
+	if ok && call.hostport == msg.From {
+		delete(m.pendingCalls, msg.id)
+	}
+	m.callsLock.Unlock()
+
+	if !ok {
+		m.logger.Warningf("No pending call for response %d\n", msg.id)
+		return
+	}
+	if call.hostport != msg.From {
+		m.logger.Warningf("Response %d from %v, but the request is sent to %v\n", msg.id, msg.From, call.hostport)
+		return
+	}
+	call.resp <- msg.Body
+}
+
 // Recv a message.
 func (m *Messenger) Recv() (interface{}, error) {
+	_, msg, err := m.RecvFrom()
+	return msg, err
+}
+
+// RecvFrom receives a message along with the address of the sender.
+func (m *Messenger) RecvFrom() (string, interface{}, error) {
 	msg, ok := <-m.recvQueue
 	if !ok {
-		return nil, fmt.Errorf("Failed to receive, channel closed\n")
+		return "", nil, fmt.Errorf("Failed to receive, channel closed\n")
 	}
-	return msg, nil
+	return msg.From, msg.Body, nil
 }
 
 // Destroy the messenger.
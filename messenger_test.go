@@ -1,8 +1,17 @@
 package messenger
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,30 +28,29 @@ var count3 int
 var count4 int
 
 // Simple message handlers used for testing.
-func handler1(msg interface{}) {
+func handler1(msg *Message) {
 	count1++
 }
 
-func handler2(msg interface{}) {
+func handler2(msg *Message) {
 	count2++
 }
 
-func handler3(msg interface{}) {
+func handler3(msg *Message) {
 	count3++
 }
 
-func handler4(msg interface{}) {
+func handler4(msg *Message) {
 	count4++
 }
 
 // A simple echo server used for testing.
 type echoServer struct {
-	m        *Messenger
-	peerAddr string
+	m *Messenger
 }
 
-func (e *echoServer) msgHandler(msg interface{}) {
-	e.m.Send(e.peerAddr, msg)
+func (e *echoServer) msgHandler(msg *Message) {
+	e.m.Send(msg.From, msg.Body)
 }
 
 func generateMessages(n int) []proto.Message {
@@ -87,6 +95,9 @@ func generateMessages(n int) []proto.Message {
 
 // Test Send() and Recv() of the messenger.
 func TestSendRecv(t *testing.T) {
+	// The counters are left over if the test is run more than once.
+	count1, count2, count3, count4 = 0, 0, 0, 0
+
 	// Create the sender.
 	c := codec.NewGoGoProtobufCodec()
 	assert.NotNil(t, c)
@@ -115,10 +126,7 @@ func TestSendRecv(t *testing.T) {
 	n := New(c, tr, false, true)
 	assert.NotNil(t, n)
 
-	e := &echoServer{
-		m:        n,
-		peerAddr: "localhost:8008",
-	}
+	e := &echoServer{m: n}
 
 	assert.NoError(t, n.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
 	assert.NoError(t, n.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
@@ -152,8 +160,9 @@ func TestSendRecv(t *testing.T) {
 				return
 			default:
 			}
-			msg, err := m.Recv()
+			from, msg, err := m.RecvFrom()
 			assert.NoError(t, err)
+			assert.Equal(t, "localhost:8009", from)
 
 			recvMessages = append(recvMessages, msg)
 		}
@@ -177,3 +186,1430 @@ func TestSendRecv(t *testing.T) {
 	assert.NoError(t, m.Destroy())
 	assert.NoError(t, n.Destroy())
 }
+
+// Create a messenger atop the memory network with the test messages registered.
+func newMemoryMessenger(t *testing.T, network *transporter.MemoryNetwork, hostport string) *Messenger {
+	m := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, hostport), false, true)
+	assert.NotNil(t, m)
+
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	return m
+}
+
+// Test Call() and Reply() of the messenger.
+func TestCall(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+
+	// Reply to message1 with a message2 that carries the same fields.
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		assert.True(t, msg.IsRequest())
+		assert.Equal(t, "client", msg.From)
+		req := msg.Body.(*example.GoGoProtobufTestMessage1)
+		assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{
+			F0: req.F0,
+			F1: req.F1,
+			F2: req.F2,
+		}))
+	}))
+	// Never reply to message3.
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage3{}, func(msg *Message) {
+		assert.Error(t, msg.Reply(&example.GoGoProtobufTestMessage4{}))
+	}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := client.Call(ctx, "server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String(fmt.Sprintf("%10d", i)),
+			F2: proto.Float32(float32(i)),
+		})
+		cancel()
+		assert.NoError(t, err)
+		assert.Equal(t, &example.GoGoProtobufTestMessage2{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String(fmt.Sprintf("%10d", i)),
+			F2: proto.Float32(float32(i)),
+		}, resp)
+	}
+
+	// Should time out since the server never replies.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	_, err := client.Call(ctx, "server", &example.GoGoProtobufTestMessage3{
+		F0: proto.Int32(3),
+		F1: proto.String("hello"),
+		F2: proto.String("world"),
+	})
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Should fail because the message is not registered.
+	_, err = client.Call(context.Background(), "server", &example.GoGoProtobufTestMessage4{})
+	assert.Error(t, err)
+
+	// Should fail at once if the request cannot be sent.
+	start := time.Now()
+	_, err = client.Call(context.Background(), "unknown", &example.GoGoProtobufTestMessage3{
+		F0: proto.Int32(3),
+		F1: proto.String("hello"),
+		F2: proto.String("world"),
+	})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Pending calls should return once the messenger is stopped.
+	done := make(chan error)
+	go func() {
+		_, err := client.Call(context.Background(), "server", &example.GoGoProtobufTestMessage3{
+			F0: proto.Int32(3),
+			F1: proto.String("hello"),
+			F2: proto.String("world"),
+		})
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, client.Stop())
+
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("Pending call is not cleaned up after Stop()")
+	}
+	assert.NoError(t, server.Stop())
+}
+
+// The frames sent by the peers that predate the envelope.
+func TestBareFrame(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	server := newMemoryMessenger(t, network, "server")
+	received := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		received <- msg
+	}))
+	assert.NoError(t, server.Start())
+	raw := transporter.NewMemoryTransporter(network, "raw")
+	assert.NoError(t, raw.Listen())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	c := codec.NewGoGoProtobufCodec()
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	b, err := c.Marshal(msg)
+	assert.NoError(t, err)
+	body, err := proto.Marshal(msg)
+	assert.NoError(t, err)
+
+	// The codec payload, and the legacy one with the trailing type byte.
+	for _, frame := range [][]byte{b, append(body, 0)} {
+		assert.NoError(t, raw.Send("server", frame))
+		m := <-received
+		assert.Equal(t, "raw", m.From)
+		assert.Equal(t, msg, m.Body)
+		assert.False(t, m.IsRequest())
+		assert.Nil(t, m.Header)
+	}
+
+	assert.NoError(t, server.Stop())
+	assert.NoError(t, raw.Stop())
+}
+
+// A transporter that sends every message twice.
+type duplicatingTransporter struct {
+	transporter.Transporter
+}
+
+func (d *duplicatingTransporter) Send(hostport string, b []byte) error {
+	if err := d.Transporter.Send(hostport, b); err != nil {
+		return err
+	}
+	return d.Transporter.Send(hostport, b)
+}
+
+// Test the reliable delivery of the messenger.
+func TestReliable(t *testing.T) {
+	var received int32
+
+	network := transporter.NewMemoryNetwork()
+	client := New(codec.NewGoGoProtobufCodec(),
+		&duplicatingTransporter{transporter.NewMemoryTransporter(network, "client")}, false, true)
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	client.EnableReliable(time.Second * 10)
+
+	server := newMemoryMessenger(t, network, "server")
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		atomic.AddInt32(&received, 1)
+	}))
+
+	assert.NoError(t, client.Start())
+
+	// The server is not started yet, so the messages
+	// can only be delivered by the retransmission.
+	cnt := 100
+	for i := 0; i < cnt; i++ {
+		assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String(fmt.Sprintf("%10d", i)),
+			F2: proto.Float32(float32(i)),
+		}))
+	}
+	assert.NoError(t, server.Start())
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&received) < int32(cnt) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Wait for the duplicates, if any.
+	time.Sleep(time.Millisecond * 500)
+	assert.Equal(t, int32(cnt), atomic.LoadInt32(&received))
+
+	// All the messages should be acknowledged.
+	client.sender.Lock()
+	assert.Equal(t, 0, len(client.sender.unacked))
+	client.sender.Unlock()
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Test the dedup of the reliable receiver.
+func TestReliableReceiver(t *testing.T) {
+	r := newReliableReceiver()
+
+	assert.False(t, r.isDuplicate("a", 1, 2))
+	assert.False(t, r.isDuplicate("a", 1, 1))
+	assert.True(t, r.isDuplicate("a", 1, 1))
+	assert.True(t, r.isDuplicate("a", 1, 2))
+	assert.False(t, r.isDuplicate("a", 1, 4))
+	assert.True(t, r.isDuplicate("a", 1, 4))
+	assert.False(t, r.isDuplicate("a", 1, 3))
+	assert.Equal(t, uint64(4), r.peers["a"].floor)
+	assert.Equal(t, 0, len(r.peers["a"].seen))
+
+	// Other peers are independent.
+	assert.False(t, r.isDuplicate("b", 1, 1))
+
+	// A restarted peer starts over, even if its epoch is smaller.
+	assert.False(t, r.isDuplicate("a", 2, 1))
+	assert.True(t, r.isDuplicate("a", 2, 1))
+	assert.False(t, r.isDuplicate("a", 0, 1))
+
+	// The epochs don't depend on the clock.
+	assert.NotEqual(t, randomID(), randomID())
+}
+
+// Test the ack never blocks the incoming loop.
+func TestSendAck(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+
+	// Should drop the ack rather than block if the queue is full,
+	// no matter what the queue policy is.
+	m := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "block"), false, true,
+		WithQueueSizes(0, 1, 0), WithQueuePolicy(QueueBlock))
+	done := make(chan struct{})
+	go func() {
+		m.sendAck("peer", 1, 1)
+		m.sendAck("peer", 1, 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Ack blocks when the queue is full")
+	}
+	assert.Equal(t, 1, len(m.ackQueue))
+	assert.Equal(t, int64(1), m.Stats().Dropped)
+}
+
+func TestRegisterMessageWithID(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	msgs := []interface{}{
+		&example.GoGoProtobufTestMessage1{},
+		&example.GoGoProtobufTestMessage2{},
+		&example.GoGoProtobufTestMessage3{},
+	}
+
+	// The nodes register the messages in different orders.
+	client := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "client"), false, true)
+	for i := range msgs {
+		assert.NoError(t, client.RegisterMessageWithID(uint32(100+i), msgs[i]))
+	}
+	server := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "server"), false, true)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		assert.NoError(t, server.RegisterMessageWithID(uint32(100+i), msgs[i]))
+	}
+	assert.Error(t, server.RegisterMessageWithID(200, msgs[0]))
+	assert.Error(t, server.RegisterMessage(msgs[0]))
+
+	received := make(chan interface{}, 1)
+	assert.NoError(t, client.RegisterHandler(&example.GoGoProtobufTestMessage3{}, func(msg *Message) {
+		received <- msg.Body
+	}))
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		req := msg.Body.(*example.GoGoProtobufTestMessage1)
+		assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{F0: req.F0, F1: req.F1, F2: req.F2}))
+		assert.NoError(t, msg.m.Send(msg.From, &example.GoGoProtobufTestMessage3{
+			F0: req.F0,
+			F1: req.F1,
+			F2: proto.String("world"),
+		}))
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	resp, err := client.Call(ctx, "server", &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	})
+	cancel()
+	assert.NoError(t, err)
+	assert.Equal(t, &example.GoGoProtobufTestMessage2{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}, resp)
+	assert.Equal(t, &example.GoGoProtobufTestMessage3{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.String("world"),
+	}, <-received)
+
+	// Should fail if the codec cannot take the IDs.
+	m := New(codec.NewJSONCodec(), transporter.NewMemoryTransporter(network, "json"), false, true)
+	assert.Error(t, m.RegisterMessageWithID(1, msgs[0]))
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Test that Start() returns as soon as the transporter is ready,
+// or returns the error of binding the address.
+func TestStart(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	m := newMemoryMessenger(t, network, "node")
+	n := newMemoryMessenger(t, network, "node")
+
+	start := time.Now()
+	assert.NoError(t, m.Start())
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+
+	// Should fail because the address is in use.
+	assert.Error(t, n.Start())
+
+	assert.NoError(t, m.Stop())
+}
+
+// Test the concurrent dispatching with per type ordering.
+func TestDispatcher(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+	server.SetDispatcher(DispatchOrderedByType, 4)
+
+	cnt := 100
+	slowDone := make(chan struct{})
+	fastDone := make(chan struct{})
+
+	// The slow handler blocks until all the fast messages are handled.
+	var slowSeen []int32
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		if len(slowSeen) == 0 {
+			<-fastDone
+		}
+		slowSeen = append(slowSeen, msg.Body.(*example.GoGoProtobufTestMessage1).GetF0())
+		if len(slowSeen) == cnt {
+			close(slowDone)
+		}
+	}))
+	var fastSeen []int32
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage2{}, func(msg *Message) {
+		fastSeen = append(fastSeen, msg.Body.(*example.GoGoProtobufTestMessage2).GetF0())
+		if len(fastSeen) == cnt {
+			close(fastDone)
+		}
+	}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	for i := 0; i < cnt; i++ {
+		assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String("slow"),
+			F2: proto.Float32(float32(i)),
+		}))
+		assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage2{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String("fast"),
+			F2: proto.Float32(float32(i)),
+		}))
+	}
+
+	select {
+	case <-slowDone:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The slow handler stalls the other message types")
+	}
+
+	// The messages of the same type should be handled in order.
+	for i := 0; i < cnt; i++ {
+		assert.Equal(t, int32(i), slowSeen[i])
+		assert.Equal(t, int32(i), fastSeen[i])
+	}
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Test SendContext() of the messenger.
+func TestSendContext(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {}))
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+
+	// Should time out since the queue is full and nobody consumes it.
+	for i := 0; i < defaultQueueSize; i++ {
+		assert.NoError(t, client.Send("server", msg))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	_, err := client.SendContext(ctx, "server", msg)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	// Should succeed.
+	result, err := client.SendContext(context.Background(), "server", msg)
+	assert.NoError(t, err)
+	assert.NoError(t, <-result)
+
+	// Should fail because the message is not registered.
+	_, err = client.SendContext(context.Background(), "server", &example.GoGoProtobufTestMessage4{})
+	assert.Error(t, err)
+
+	// Should report the error of the transporter.
+	result, err = client.SendContext(context.Background(), "unknown", msg)
+	assert.NoError(t, err)
+	assert.Error(t, <-result)
+
+	assert.NoError(t, client.Stop())
+
+	// Should fail because the messenger is stopped.
+	_, err = client.SendContext(context.Background(), "server", msg)
+	assert.Equal(t, ErrStopped, err)
+
+	assert.NoError(t, server.Stop())
+}
+
+// Test SendContext() in the reliable mode.
+func TestSendContextReliable(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	client.EnableReliable(time.Millisecond * 500)
+	server := newMemoryMessenger(t, network, "server")
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+
+	// Should be reported once acknowledged.
+	result, err := client.SendContext(context.Background(), "server", msg)
+	assert.NoError(t, err)
+	assert.NoError(t, <-result)
+
+	// Should be reported after the deadline.
+	result, err = client.SendContext(context.Background(), "unknown", msg)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrNotAcknowledged, <-result)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// A transporter whose Send() stalls until it's released.
+type stallingTransporter struct {
+	transporter.Transporter
+	release chan struct{}
+}
+
+func (b *stallingTransporter) Send(hostport string, data []byte) error {
+	<-b.release
+	return b.Transporter.Send(hostport, data)
+}
+
+func TestSendContextStop(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	tr := &stallingTransporter{transporter.NewMemoryTransporter(network, "client"), make(chan struct{})}
+	client := New(codec.NewGoGoProtobufCodec(), tr, false, true, WithReliable(time.Minute))
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	// The server never acks.
+	server := transporter.NewMemoryTransporter(network, "server")
+	assert.NoError(t, server.Listen())
+	assert.NoError(t, client.Start())
+
+	// The first message is being sent, the others are queued.
+	var results []<-chan error
+	for i := 0; i < 3; i++ {
+		result, err := client.SendContext(context.Background(), "server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String("hello"),
+			F2: proto.Float32(4.2),
+		})
+		assert.NoError(t, err)
+		results = append(results, result)
+	}
+	assert.NoError(t, client.Stop())
+	close(tr.release)
+
+	// Should report all of them.
+	for _, result := range results {
+		select {
+		case err := <-result:
+			assert.Equal(t, ErrStopped, err)
+		case <-time.After(time.Second):
+			t.Fatal("Result is not reported after Stop()")
+		}
+	}
+	assert.NoError(t, server.Stop())
+}
+
+// A logger that counts the warnings.
+type countingLogger struct {
+	warnings int32
+}
+
+func (l *countingLogger) Debugf(format string, args ...interface{}) {}
+func (l *countingLogger) Infof(format string, args ...interface{})  {}
+func (l *countingLogger) Warningf(format string, args ...interface{}) {
+	atomic.AddInt32(&l.warnings, 1)
+}
+
+// A metrics sink that remembers the counters.
+type countingSink struct {
+	sync.Mutex
+	counters map[string]int64
+}
+
+func newCountingSink() *countingSink {
+	return &countingSink{counters: make(map[string]int64)}
+}
+
+func (s *countingSink) IncrCounter(name string, delta int64) {
+	s.Lock()
+	s.counters[name] += delta
+	s.Unlock()
+}
+
+func (s *countingSink) SetGauge(name string, value int64)           {}
+func (s *countingSink) ObserveLatency(name string, d time.Duration) {}
+
+func (s *countingSink) counter(name string) int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.counters[name]
+}
+
+// A transporter that never gets ready.
+type blockingTransporter struct {
+	transporter.Transporter
+}
+
+func (b *blockingTransporter) Listen() error {
+	select {}
+}
+
+// Test the options of the messenger.
+func TestOptions(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	logger := &countingLogger{}
+	sink := newCountingSink()
+
+	m := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "node"), true, true,
+		WithQueueSizes(1, 2, 3),
+		WithQueuePolicy(QueueDrop),
+		WithLogger(logger),
+		WithMetricsSink(sink),
+		WithDispatcher(DispatchConcurrent, 2),
+		WithReliable(time.Second))
+	assert.NotNil(t, m)
+	assert.Equal(t, 1, cap(m.inQueue))
+	assert.Equal(t, 2, cap(m.outQueue))
+	assert.Equal(t, 3, cap(m.recvQueue))
+	assert.Equal(t, DispatchConcurrent, m.dispatcher.mode)
+	assert.Equal(t, 2, len(m.dispatcher.queues))
+	assert.NotNil(t, m.sender)
+
+	// Should drop the message since the queue is full.
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.Send("node", msg))
+	assert.NoError(t, m.Send("node", msg))
+	assert.Equal(t, ErrQueueFull, m.Send("node", msg))
+	assert.Equal(t, int64(1), sink.counter(MetricDropped))
+
+	// Should use the logger.
+	assert.Nil(t, New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "node"),
+		false, false, WithLogger(logger)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logger.warnings))
+
+	// Should give up if the transporter is not ready in time.
+	n := New(codec.NewGoGoProtobufCodec(), &blockingTransporter{}, false, true,
+		WithStartTimeout(time.Millisecond*100))
+	assert.Error(t, n.Start())
+}
+
+// Test the Stats() of the messenger.
+func TestStats(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+
+	done := make(chan struct{}, 100)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		done <- struct{}{}
+	}))
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage3{}, func(msg *Message) {
+		assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{}))
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String("hello"),
+			F2: proto.Float32(4.2),
+		}))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Not enough messages handled, waited 1s")
+		}
+	}
+	// Should fail to send since there is no such peer.
+	assert.NoError(t, client.Send("unknown", &example.GoGoProtobufTestMessage2{}))
+	time.Sleep(time.Millisecond * 100)
+
+	msgType := reflect.TypeOf(&example.GoGoProtobufTestMessage1{}).String()
+	stats := client.Stats()
+	assert.Equal(t, int64(100), stats.Sent[msgType])
+	assert.Equal(t, int64(1), stats.TransportErrors)
+	assert.Equal(t, int64(100), stats.Peers["server"].MessagesSent)
+	assert.Equal(t, int64(1), stats.Peers["unknown"].SendErrors)
+
+	stats = server.Stats()
+	assert.Equal(t, int64(100), stats.Received[msgType])
+	assert.Equal(t, int64(100), stats.HandlerLatency[msgType].Count)
+	assert.Equal(t, int64(100), stats.Peers["client"].MessagesReceived)
+	assert.Equal(t, 0, stats.InQueueDepth)
+
+	// Should export the stats by expvar.
+	name := fmt.Sprintf("messenger.test.%d", time.Now().UnixNano())
+	assert.NoError(t, PublishExpvar(name, server))
+	v := expvar.Get(name)
+	assert.NotNil(t, v)
+	assert.Contains(t, v.String(), msgType)
+	assert.Error(t, PublishExpvar(name, client))
+	_, err := NewExpvarSink(name)
+	assert.Error(t, err)
+	sink, err := NewExpvarSink(name + ".sink")
+	assert.NoError(t, err)
+	sink.IncrCounter(MetricSent, 1)
+	assert.Equal(t, `{"messenger.sent": 1}`, expvar.Get(name+".sink").String())
+
+	// Should count the responses.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err = client.Call(ctx, "server", &example.GoGoProtobufTestMessage3{
+		F0: proto.Int32(3),
+		F1: proto.String("hello"),
+		F2: proto.String("world"),
+	})
+	cancel()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), client.Stats().Received[reflect.TypeOf(&example.GoGoProtobufTestMessage2{}).String()])
+
+	// Should count the acks that cannot be sent, the sender doesn't listen.
+	ghost := transporter.NewMemoryTransporter(network, "ghost")
+	payload, err := server.codec.Marshal(&example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	})
+	assert.NoError(t, err)
+	e := &envelope{kind: kindMessage, epoch: 1, seq: 1, payload: payload}
+	assert.NoError(t, ghost.Send("server", e.marshal()))
+	<-done
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int64(1), server.Stats().TransportErrors)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	h.observe(time.Microsecond)
+	h.observe(time.Millisecond * 5)
+	h.observe(time.Minute)
+	assert.Equal(t, int64(3), h.Count)
+	assert.Equal(t, int64(1), h.Counts[0])
+	assert.Equal(t, int64(1), h.Counts[2])
+	assert.Equal(t, int64(1), h.Counts[len(h.Counts)-1])
+	assert.Equal(t, (time.Microsecond+time.Millisecond*5+time.Minute)/3, h.Mean())
+}
+
+// Test the messages are encoded by the codec of the messenger.
+func TestMarshal(t *testing.T) {
+	c := codec.NewGoGoProtobufCodec()
+	m := New(c, transporter.NewMemoryTransporter(transporter.NewMemoryNetwork(), "node"), false, true)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	// The codec knows the second message but the messenger doesn't.
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	b, err := m.Marshal(msg)
+	assert.NoError(t, err)
+	decoded, err := m.Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// Should fail because the message is not registered.
+	_, err = m.Marshal(&example.GoGoProtobufTestMessage2{})
+	assert.Error(t, err)
+	b, err = c.Marshal(&example.GoGoProtobufTestMessage2{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	})
+	assert.NoError(t, err)
+	_, err = m.Unmarshal(b)
+	assert.Error(t, err)
+}
+
+// The reliable delivery over real sockets that lose
+// and duplicate the messages.
+func TestReliableFaulty(t *testing.T) {
+	var received int32
+
+	faults := transporter.Faults{DropRate: 0.2, DuplicateRate: 0.1}
+	client := New(codec.NewGoGoProtobufCodec(),
+		transporter.NewFaultyTransporter(transporter.NewHTTPTransporter("localhost:8010"), faults), false, true)
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	client.EnableReliable(time.Second * 10)
+
+	server := New(codec.NewGoGoProtobufCodec(),
+		transporter.NewFaultyTransporter(transporter.NewHTTPTransporter("localhost:8011"), faults), false, true)
+	assert.NotNil(t, server)
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		atomic.AddInt32(&received, 1)
+	}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	cnt := 100
+	for i := 0; i < cnt; i++ {
+		assert.NoError(t, client.Send("localhost:8011", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String(fmt.Sprintf("%10d", i)),
+			F2: proto.Float32(float32(i)),
+		}))
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for atomic.LoadInt32(&received) < int32(cnt) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Wait for the duplicates, if any.
+	time.Sleep(time.Millisecond * 500)
+	assert.Equal(t, int32(cnt), atomic.LoadInt32(&received))
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// A transporter that authenticates every peer by its address.
+type authenticatingTransporter struct {
+	transporter.Transporter
+}
+
+func (a *authenticatingTransporter) RecvFromPeer() (string, []byte, *transporter.PeerInfo, error) {
+	from, b, err := a.RecvFrom()
+	return from, b, &transporter.PeerInfo{CommonName: from}, err
+}
+
+// Test the identity of the peer is passed to the handlers.
+func TestPeerIdentity(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := New(codec.NewGoGoProtobufCodec(),
+		&authenticatingTransporter{transporter.NewMemoryTransporter(network, "server")}, false, true)
+	assert.NotNil(t, server)
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	peers := make(chan *transporter.PeerInfo, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		peers <- msg.Peer
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}))
+	select {
+	case peer := <-peers:
+		assert.NotNil(t, peer)
+		assert.Equal(t, "client", peer.CommonName)
+	case <-time.After(time.Second):
+		t.Fatal("Message is not delivered, waited 1s")
+	}
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Test the wire format of the envelope.
+func TestEnvelope(t *testing.T) {
+	e := &envelope{
+		kind:    kindRequest,
+		id:      1,
+		epoch:   2,
+		seq:     3,
+		header:  Header{"trace-id": "abc", "deadline": "", "": "empty key"},
+		payload: []byte("hello"),
+	}
+	b := e.marshal()
+	assert.Equal(t, byte(versionFlag|envelopeVersion), b[0])
+	decoded, err := unmarshalEnvelope(b)
+	assert.NoError(t, err)
+	assert.Equal(t, e, decoded)
+
+	// Should omit the headers if there is none.
+	e.header = nil
+	decoded, err = unmarshalEnvelope(e.marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, e, decoded)
+
+	// Should read the version 1 envelope.
+	decoded, err = unmarshalEnvelope([]byte{byte(kindRequest), 1, 2, 3, 'h', 'e', 'l', 'l', 'o'})
+	assert.NoError(t, err)
+	assert.Equal(t, e, decoded)
+
+	// Should reject the unknown versions and the malformed headers.
+	_, err = parseEnvelope([]byte{versionFlag | 3, byte(kindMessage), 0, 0, 0, 0})
+	assert.Error(t, err)
+	e.header = Header{"key": "value"}
+	b = e.marshal()
+	_, err = parseEnvelope(b[:8])
+	assert.Error(t, err)
+	_, err = parseEnvelope([]byte{versionFlag | envelopeVersion})
+	assert.Error(t, err)
+	_, err = unmarshalEnvelope(nil)
+	assert.Error(t, err)
+
+	// Should not take the truncated or newer envelopes as bare payloads.
+	for _, b := range [][]byte{
+		b[:8],
+		{versionFlag | envelopeVersion},
+		{versionFlag | 3, byte(kindMessage), 0, 0, 0, 0},
+		{0xff, 1, 2, 3},
+	} {
+		_, err = unmarshalEnvelope(b)
+		assert.Error(t, err)
+	}
+
+	// Should take the rest as bare payloads.
+	for _, b := range [][]byte{
+		[]byte(`{"type": "message", "body": {}}`),
+		{0x07, 1, 0x08, 1},
+		{0x08, 1, 0},
+		{0},
+		{versionFlag | 1, 0},
+	} {
+		decoded, err = unmarshalEnvelope(b)
+		assert.NoError(t, err)
+		assert.Equal(t, &envelope{kind: kindMessage, payload: b}, decoded)
+	}
+}
+
+// Test the headers are passed to the handlers.
+func TestHeader(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+
+	headers := make(chan Header, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		headers <- msg.Header
+		if msg.IsRequest() {
+			assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{}))
+		}
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, client.SendWithHeader("server", msg, Header{"trace-id": "1"}))
+	assert.Equal(t, Header{"trace-id": "1"}, <-headers)
+
+	assert.NoError(t, client.Send("server", msg))
+	assert.Nil(t, <-headers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err := client.Call(ContextWithHeader(ctx, Header{"trace-id": "2"}), "server", msg)
+	cancel()
+	assert.NoError(t, err)
+	assert.Equal(t, Header{"trace-id": "2"}, <-headers)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+func TestInterceptor(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+	other := newMemoryMessenger(t, network, "other")
+
+	// The client signs the messages and rejects the second type.
+	errRejected := errors.New("Rejected")
+	var order []string
+	client.Use(Interceptor{Outbound: func(out *OutgoingMessage, next OutboundHandler) error {
+		order = append(order, "sign")
+		header := Header{"token": "secret"}
+		for k, v := range out.Header {
+			header[k] = v
+		}
+		out.Header = header
+		return next(out)
+	}})
+	client.Use(Interceptor{Outbound: func(out *OutgoingMessage, next OutboundHandler) error {
+		order = append(order, "reject")
+		if _, ok := out.Body.(*example.GoGoProtobufTestMessage2); ok {
+			return errRejected
+		}
+		return next(out)
+	}})
+
+	// The server drops the unsigned messages and marks the rest.
+	dropped := make(chan string, 1)
+	server.Use(Interceptor{Inbound: func(msg *Message, next MessageHandler) {
+		if msg.Header["token"] != "secret" {
+			dropped <- msg.From
+			return
+		}
+		next(msg)
+	}})
+	server.Use(Interceptor{Inbound: func(msg *Message, next MessageHandler) {
+		msg.Header["checked"] = "yes"
+		next(msg)
+	}})
+	received := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		received <- msg
+	}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+	assert.NoError(t, other.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, client.SendWithHeader("server", msg, Header{"trace-id": "1"}))
+	m := <-received
+	assert.Equal(t, "client", m.From)
+	assert.Equal(t, Header{"trace-id": "1", "token": "secret", "checked": "yes"}, m.Header)
+
+	// Should report the error of the interceptor.
+	result, err := client.SendContext(context.Background(), "server", &example.GoGoProtobufTestMessage2{})
+	assert.NoError(t, err)
+	assert.Equal(t, errRejected, <-result)
+	assert.Equal(t, []string{"sign", "reject", "sign", "reject"}, order)
+
+	// Should not reach the handler.
+	assert.NoError(t, other.Send("server", msg))
+	assert.Equal(t, "other", <-dropped)
+	assert.Equal(t, 0, len(received))
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+	assert.NoError(t, other.Stop())
+}
+
+// Test the responses to Call() pass through the inbound interceptors.
+func TestInterceptorResponse(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+	server := newMemoryMessenger(t, network, "server")
+
+	// The client drops the responses with a negative F0.
+	responses := make(chan *Message, 1)
+	client.Use(Interceptor{Inbound: func(msg *Message, next MessageHandler) {
+		assert.True(t, msg.IsResponse())
+		assert.False(t, msg.IsRequest())
+		responses <- msg
+		if msg.Body.(*example.GoGoProtobufTestMessage2).GetF0() < 0 {
+			return
+		}
+		next(msg)
+	}})
+	requests := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		requests <- msg
+		f0 := msg.Body.(*example.GoGoProtobufTestMessage1).GetF0()
+		if f0 != 0 {
+			assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{F0: proto.Int32(f0)}))
+		}
+	}))
+
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+	forger := transporter.NewMemoryTransporter(network, "forger")
+	assert.NoError(t, forger.Listen())
+
+	call := func(f0 int32) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		return client.Call(ctx, "server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(f0),
+			F1: proto.String("hello"),
+			F2: proto.Float32(4.2),
+		})
+	}
+
+	resp, err := call(1)
+	assert.NoError(t, err)
+	assert.Equal(t, &example.GoGoProtobufTestMessage2{F0: proto.Int32(1)}, resp)
+	m := <-responses
+	assert.Equal(t, "server", m.From)
+	assert.Equal(t, resp, m.Body)
+	<-requests
+
+	// Should not complete the call if the interceptor drops the response.
+	_, err = call(-1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, "server", (<-responses).From)
+	<-requests
+
+	// Should not complete the call with a response from another peer.
+	done := make(chan error, 1)
+	go func() {
+		_, err := call(0)
+		done <- err
+	}()
+	req := <-requests
+	payload, err := client.codec.Marshal(&example.GoGoProtobufTestMessage2{F0: proto.Int32(0)})
+	assert.NoError(t, err)
+	e := &envelope{kind: kindResponse, id: req.id, payload: payload}
+	assert.NoError(t, forger.Send("client", e.marshal()))
+	assert.Equal(t, "forger", (<-responses).From)
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+	assert.NoError(t, forger.Stop())
+}
+
+func TestHandlerPanic(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchInline, DispatchConcurrent} {
+		network := transporter.NewMemoryNetwork()
+		client := newMemoryMessenger(t, network, "client")
+
+		errs := make(chan error, 1)
+		deadLetters := make(chan *DeadLetter, 1)
+		server := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "server"), false, true,
+			WithDispatcher(mode, 0),
+			WithErrorHook(func(err error) { errs <- err }),
+			WithDeadLetterSink(func(dl *DeadLetter) { deadLetters <- dl }))
+		assert.NotNil(t, server)
+		assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+		handled := make(chan int32, 1)
+		assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+			f0 := msg.Body.(*example.GoGoProtobufTestMessage1).GetF0()
+			if f0 == 0 {
+				panic("boom")
+			}
+			handled <- f0
+		}))
+		assert.NoError(t, client.Start())
+		assert.NoError(t, server.Start())
+
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+				F0: proto.Int32(int32(i)),
+				F1: proto.String("hello"),
+				F2: proto.Float32(4.2),
+			}))
+		}
+
+		// Should keep handling the messages after the panic.
+		assert.Equal(t, int32(1), <-handled)
+
+		err, ok := (<-errs).(*PanicError)
+		assert.True(t, ok)
+		assert.Equal(t, "boom", err.Value)
+		assert.Equal(t, "client", err.Message.From)
+		assert.Contains(t, string(err.Stack), "TestHandlerPanic")
+
+		dl := <-deadLetters
+		assert.Equal(t, DeadLetterPanic, dl.Reason)
+		assert.Equal(t, err, dl.Err)
+		assert.Equal(t, err.Message, dl.Message)
+		assert.Equal(t, int64(1), server.Stats().HandlerPanics)
+
+		assert.NoError(t, client.Stop())
+		assert.NoError(t, server.Stop())
+	}
+}
+
+// Test the panics of the inbound interceptors are recovered.
+func TestInterceptorPanic(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	client := newMemoryMessenger(t, network, "client")
+
+	errs := make(chan error, 1)
+	deadLetters := make(chan *DeadLetter, 1)
+	server := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "server"), false, true,
+		WithErrorHook(func(err error) { errs <- err }),
+		WithDeadLetterSink(func(dl *DeadLetter) { deadLetters <- dl }))
+	assert.NotNil(t, server)
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	// Panics if there is no header.
+	server.Use(Interceptor{Inbound: func(msg *Message, next MessageHandler) {
+		msg.Header["checked"] = "yes"
+		next(msg)
+	}})
+
+	handled := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		handled <- msg
+	}))
+	assert.NoError(t, client.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		assert.NoError(t, msg.Reply(&example.GoGoProtobufTestMessage2{}))
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, client.Send("server", msg))
+	err, ok := (<-errs).(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "client", err.Message.From)
+	assert.Contains(t, string(err.Stack), "TestInterceptorPanic")
+	dl := <-deadLetters
+	assert.Equal(t, DeadLetterPanic, dl.Reason)
+	assert.Equal(t, err, dl.Err)
+	assert.Equal(t, int64(1), server.Stats().HandlerPanics)
+
+	// Should keep reading the messages after the panic.
+	assert.NoError(t, client.SendWithHeader("server", msg, Header{"trace-id": "1"}))
+	assert.Equal(t, Header{"trace-id": "1", "checked": "yes"}, (<-handled).Header)
+
+	// Should recover the panic on the response in the incoming loop.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	_, callErr := server.Call(ctx, "client", msg)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, callErr)
+	err, ok = (<-errs).(*PanicError)
+	assert.True(t, ok)
+	assert.True(t, err.Message.IsResponse())
+	assert.Equal(t, DeadLetterPanic, (<-deadLetters).Reason)
+	assert.Equal(t, int64(2), server.Stats().HandlerPanics)
+
+	assert.NoError(t, client.SendWithHeader("server", msg, Header{"trace-id": "2"}))
+	assert.Equal(t, Header{"trace-id": "2", "checked": "yes"}, (<-handled).Header)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Test the panics of the outbound interceptors are recovered,
+// and a nil message set by an interceptor is rejected.
+func TestOutboundPanic(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	server := newMemoryMessenger(t, network, "server")
+
+	errs := make(chan error, 1)
+	deadLetters := make(chan *DeadLetter, 2)
+	client := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "client"), false, true,
+		WithErrorHook(func(err error) { errs <- err }),
+		WithDeadLetterSink(func(dl *DeadLetter) { deadLetters <- dl }))
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	client.Use(Interceptor{Outbound: func(msg *OutgoingMessage, next OutboundHandler) error {
+		switch msg.Header["action"] {
+		case "panic":
+			panic("boom")
+		case "nil":
+			msg.Body = nil
+		}
+		return next(msg)
+	}})
+
+	handled := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		handled <- msg
+	}))
+	assert.NoError(t, server.Start())
+	assert.NoError(t, client.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	send := func(action string) error {
+		ctx := ContextWithHeader(context.Background(), Header{"action": action})
+		result, err := client.SendContext(ctx, "server", msg)
+		assert.NoError(t, err)
+		return <-result
+	}
+
+	// Should report the panic to the sender.
+	err := send("panic")
+	panicErr, ok := err.(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.Equal(t, err, <-errs)
+	dl := <-deadLetters
+	assert.Equal(t, DeadLetterPanic, dl.Reason)
+	assert.Equal(t, "server", dl.Addr)
+	assert.Equal(t, err, dl.Err)
+	assert.Equal(t, int64(1), client.Stats().HandlerPanics)
+
+	// Should reject the nil message.
+	assert.Error(t, send("nil"))
+	dl = <-deadLetters
+	assert.Equal(t, DeadLetterMarshal, dl.Reason)
+	assert.Equal(t, "", dl.Type)
+
+	// Should keep sending the messages.
+	assert.NoError(t, send("none"))
+	assert.Equal(t, "none", (<-handled).Header["action"])
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+func TestDeadLetter(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	clientDeadLetters := make(chan *DeadLetter, 1)
+	client := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "client"), false, true,
+		WithDeadLetterSink(func(dl *DeadLetter) { clientDeadLetters <- dl }))
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.log")
+	log, err := OpenDeadLetterLog(path)
+	assert.NoError(t, err)
+
+	c := codec.NewGoGoProtobufCodec()
+	serverDeadLetters := make(chan *DeadLetter, 3)
+	server := New(c, transporter.NewMemoryTransporter(network, "server"), false, true,
+		WithDeadLetterLog(log),
+		WithDeadLetterSink(func(dl *DeadLetter) { serverDeadLetters <- dl }))
+	assert.NotNil(t, server)
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	// The codec knows the third message but the messenger doesn't.
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {}))
+
+	raw := transporter.NewMemoryTransporter(network, "raw")
+	assert.NoError(t, raw.Listen())
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	assert.NoError(t, raw.Send("server", []byte("garbage")))
+	assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage3{}))
+
+	received := make(map[DeadLetterReason]*DeadLetter)
+	for i := 0; i < 3; i++ {
+		dl := <-serverDeadLetters
+		received[dl.Reason] = dl
+	}
+	assert.Equal(t, "raw", received[DeadLetterUnmarshal].Addr)
+	assert.Equal(t, []byte("garbage"), received[DeadLetterUnmarshal].Data)
+	assert.Nil(t, received[DeadLetterUnmarshal].Message)
+	for _, reason := range []DeadLetterReason{DeadLetterNoHandler, DeadLetterUnregistered} {
+		dl := received[reason]
+		assert.Equal(t, "client", dl.Addr)
+		assert.Equal(t, reflect.TypeOf(dl.Message.Body).String(), dl.Type)
+		assert.NotEmpty(t, dl.Data)
+		assert.Error(t, dl.Err)
+	}
+
+	// Should count the frames that are not envelopes.
+	assert.NoError(t, raw.Send("server", []byte{}))
+	assert.Equal(t, DeadLetterUnmarshal, (<-serverDeadLetters).Reason)
+	assert.Equal(t, int64(2), server.Stats().UnmarshalErrors)
+
+	// Should report the send failures.
+	assert.NoError(t, client.Send("unknown", &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}))
+	dl := <-clientDeadLetters
+	assert.Equal(t, DeadLetterSendFailed, dl.Reason)
+	assert.Equal(t, "unknown", dl.Addr)
+	assert.NotEmpty(t, dl.Data)
+	// Should fail again in the outgoing loop.
+	assert.NoError(t, client.Replay(dl))
+	dl = <-clientDeadLetters
+	assert.Equal(t, DeadLetterSendFailed, dl.Reason)
+	assert.Equal(t, "unknown", dl.Addr)
+
+	assert.NoError(t, server.Stop())
+	assert.NoError(t, log.Close())
+
+	// Should read back what is written.
+	dls, err := ReadDeadLetters(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(dls))
+	assert.Empty(t, dls[3].Data)
+	for _, dl := range dls[:3] {
+		expected := received[dl.Reason]
+		assert.Equal(t, expected.Addr, dl.Addr)
+		assert.Equal(t, expected.Type, dl.Type)
+		assert.Equal(t, expected.Data, dl.Data)
+		assert.Equal(t, expected.Err.Error(), dl.Err.Error())
+		assert.True(t, expected.Time.Equal(dl.Time))
+	}
+
+	// Should replay the message once the handler is there.
+	server = newMemoryMessenger(t, network, "server")
+	handled := make(chan *Message, 1)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage2{}, func(msg *Message) {
+		handled <- msg
+	}))
+	assert.NoError(t, server.Start())
+	for _, dl := range dls {
+		if dl.Reason == DeadLetterNoHandler {
+			assert.NoError(t, server.Replay(dl))
+		}
+	}
+	msg := <-handled
+	assert.Equal(t, "client", msg.From)
+	assert.Equal(t, &example.GoGoProtobufTestMessage2{}, msg.Body)
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+	assert.NoError(t, raw.Stop())
+}
+
+// Test an outgoing dead letter is replayed through the send path.
+func TestReplayOutgoing(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	deadLetters := make(chan *DeadLetter, 1)
+	client := New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, "client"), false, true,
+		WithReliable(time.Millisecond*200),
+		WithDeadLetterSink(func(dl *DeadLetter) { deadLetters <- dl }))
+	assert.NotNil(t, client)
+	assert.NoError(t, client.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	sent := make(chan *OutgoingMessage, 1)
+	client.Use(Interceptor{Outbound: func(out *OutgoingMessage, next OutboundHandler) error {
+		err := next(out)
+		sent <- out
+		return err
+	}})
+
+	// The acks of the server are lost.
+	tr := transporter.NewFaultyTransporter(transporter.NewMemoryTransporter(network, "server"), transporter.Faults{})
+	tr.BlockOutbound("client")
+	server := New(codec.NewGoGoProtobufCodec(), tr, false, true)
+	assert.NotNil(t, server)
+	assert.NoError(t, server.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	handled := make(chan *Message, 2)
+	assert.NoError(t, server.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *Message) {
+		handled <- msg
+	}))
+	assert.NoError(t, client.Start())
+	assert.NoError(t, server.Start())
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, client.SendWithHeader("server", msg, Header{"trace-id": "1"}))
+	assert.Equal(t, msg, (<-handled).Body)
+	assert.Equal(t, "server", (<-sent).To)
+	dl := <-deadLetters
+	assert.Equal(t, DeadLetterSendFailed, dl.Reason)
+	assert.Equal(t, int64(1), client.Stats().Sent[reflect.TypeOf(msg).String()])
+
+	// Should not be taken as a duplicate by the server.
+	tr.Unblock("client")
+	assert.NoError(t, client.Replay(dl))
+	m := <-handled
+	assert.Equal(t, msg, m.Body)
+	assert.Equal(t, Header{"trace-id": "1"}, m.Header)
+	assert.Equal(t, Header{"trace-id": "1"}, (<-sent).Header)
+	assert.Equal(t, int64(2), client.Stats().Sent[reflect.TypeOf(msg).String()])
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
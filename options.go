@@ -0,0 +1,205 @@
+package messenger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// ErrQueueFull is returned by Send() if the outgoing queue is full
+// and the queue policy is QueueDrop.
+var ErrQueueFull = errors.New("Queue is full")
+
+// QueuePolicy decides what to do when a queue is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits until there is room in the queue.
+	QueueBlock QueuePolicy = iota
+	// QueueDrop drops the message. Send() returns ErrQueueFull,
+	// and the incoming messages are dropped with a warning.
+	QueueDrop
+)
+
+// MetricsSink receives the metrics of the messenger.
+type MetricsSink interface {
+	// IncrCounter adds the delta to the counter.
+	IncrCounter(name string, delta int64)
+	// SetGauge sets the current value of the gauge.
+	SetGauge(name string, value int64)
+	// ObserveLatency records a sample of the latency.
+	ObserveLatency(name string, d time.Duration)
+}
+
+// The default metrics sink that discards everything.
+type nopMetricsSink struct{}
+
+func (nopMetricsSink) IncrCounter(name string, delta int64)        {}
+func (nopMetricsSink) SetGauge(name string, value int64)           {}
+func (nopMetricsSink) ObserveLatency(name string, d time.Duration) {}
+
+// The names of the metrics reported to the MetricsSink.
+const (
+	MetricSent            = "messenger.sent"
+	MetricReceived        = "messenger.received"
+	MetricDropped         = "messenger.dropped"
+	MetricMarshalErrors   = "messenger.marshal_errors"
+	MetricUnmarshalErrors = "messenger.unmarshal_errors"
+	MetricTransportErrors = "messenger.transport_errors"
+	MetricHandlerPanics   = "messenger.handler_panics"
+	MetricHandlerLatency  = "messenger.handler_latency"
+	MetricInQueueDepth    = "messenger.in_queue_depth"
+	MetricOutQueueDepth   = "messenger.out_queue_depth"
+)
+
+// The configurable settings of a messenger.
+type options struct {
+	inQueueSize   int
+	outQueueSize  int
+	recvQueueSize int
+	dispatchMode  DispatchMode
+	workers       int
+	reliable      bool
+	deadline      time.Duration
+	logger        logger.Logger
+	queuePolicy   QueuePolicy
+	metrics       MetricsSink
+	startTimeout  time.Duration
+	errorHook     func(err error)
+	deadLetters   []DeadLetterSink
+	clock         Clock
+	idSource      func() uint64
+}
+
+func defaultOptions() *options {
+	return &options{
+		inQueueSize:   defaultQueueSize,
+		outQueueSize:  defaultQueueSize,
+		recvQueueSize: defaultQueueSize,
+		dispatchMode:  DispatchInline,
+		logger:        logger.Default(),
+		queuePolicy:   QueueBlock,
+		metrics:       nopMetricsSink{},
+		clock:         realClock{},
+		idSource:      randomID,
+	}
+}
+
+// Option configures a messenger, see New().
+type Option func(*options)
+
+// WithQueueSizes sets the sizes of the incoming, outgoing and
+// receive queues. Non-positive sizes are ignored.
+func WithQueueSizes(in, out, recv int) Option {
+	return func(o *options) {
+		if in > 0 {
+			o.inQueueSize = in
+		}
+		if out > 0 {
+			o.outQueueSize = out
+		}
+		if recv > 0 {
+			o.recvQueueSize = recv
+		}
+	}
+}
+
+// WithDispatcher sets how the messages are passed to the handlers,
+// see SetDispatcher().
+func WithDispatcher(mode DispatchMode, workers int) Option {
+	return func(o *options) {
+		o.dispatchMode = mode
+		o.workers = workers
+	}
+}
+
+// WithReliable turns on the at-least-once delivery,
+// see EnableReliable().
+func WithReliable(deadline time.Duration) Option {
+	return func(o *options) {
+		o.reliable = true
+		o.deadline = deadline
+	}
+}
+
+// WithLogger sets the logger, which writes to stderr by default.
+// Note that the codec and the transporter take their own loggers.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithQueuePolicy sets what to do when a queue is full,
+// the default is QueueBlock.
+func WithQueuePolicy(policy QueuePolicy) Option {
+	return func(o *options) {
+		o.queuePolicy = policy
+	}
+}
+
+// WithMetricsSink sets the sink of the metrics,
+// the metrics are discarded by default.
+func WithMetricsSink(sink MetricsSink) Option {
+	return func(o *options) {
+		o.metrics = sink
+	}
+}
+
+// WithStartTimeout sets how long Start() waits for the
+// transporter to be ready, zero means no timeout.
+func WithStartTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.startTimeout = timeout
+	}
+}
+
+// WithErrorHook sets the hook of the errors of the handlers, e.g.
+// a *PanicError if a handler or an interceptor panics.
+// The errors are logged by default.
+func WithErrorHook(hook func(err error)) Option {
+	return func(o *options) {
+		o.errorHook = hook
+	}
+}
+
+// WithDeadLetterSink adds a sink of the messages that cannot be
+// handled or sent, they are only logged by default. It can be given
+// more than once, the sinks are called in order.
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return func(o *options) {
+		o.deadLetters = append(o.deadLetters, sink)
+	}
+}
+
+// WithDeadLetterLog adds a sink that writes the dead letters to
+// the log, the write errors are reported to the logger.
+func WithDeadLetterLog(l *DeadLetterLog) Option {
+	return func(o *options) {
+		o.deadLetters = append(o.deadLetters, func(dl *DeadLetter) {
+			if err := l.Write(dl); err != nil {
+				o.logger.Warningf("Failed to write dead letter: %v\n", err)
+			}
+		})
+	}
+}
+
+// WithClock sets the clock of the retransmissions and the deadlines of
+// the reliable delivery, e.g. a simulation.Network so they follow its
+// virtual clock. The clock of the system is used by default.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithIDSource sets the source of the random IDs, which are the first
+// call ID and the epoch of the reliable delivery, e.g. the Uint64 of a
+// seeded math/rand.Rand so a run can be replayed. The IDs are drawn
+// from crypto/rand by default.
+func WithIDSource(src func() uint64) Option {
+	return func(o *options) {
+		o.idSource = src
+	}
+}
@@ -0,0 +1,250 @@
+// Package pubsub implements topic based publish/subscribe atop
+// a set of messengers. Each node tells its peers which topics it
+// subscribes to, so the publishers only send to the interested nodes.
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/logger"
+)
+
+// Message is a message published to a topic.
+type Message struct {
+	Topic string
+	// The address of the publisher.
+	From string
+	// The decoded message.
+	Body interface{}
+}
+
+// Handler is a callback that handles the messages of a topic.
+type Handler func(msg *Message)
+
+// PubSub delivers the messages published to a topic to
+// every node that subscribes to it.
+type PubSub struct {
+	m      *messenger.Messenger
+	logger logger.Logger
+
+	mu       sync.Mutex
+	handlers map[string]Handler         // Local subscriptions.
+	peers    map[string]map[string]bool // The topics of each peer.
+}
+
+// New creates a pubsub atop the messenger. It registers the control
+// messages of the pubsub to the messenger, so it must be called before
+// the messenger is started, and in the same order on all the nodes.
+// The published messages must be registered to the messenger as well.
+// The messenger should have the handlers enabled.
+func New(m *messenger.Messenger, opts ...Option) (*PubSub, error) {
+	o := newOptions(opts)
+	ps := &PubSub{
+		m:        m,
+		logger:   o.logger,
+		handlers: make(map[string]Handler),
+		peers:    make(map[string]map[string]bool),
+	}
+
+	handlers := []struct {
+		msg interface{}
+		h   messenger.MessageHandler
+	}{
+		{&Subscribe{}, ps.handleSubscribe},
+		{&Unsubscribe{}, ps.handleUnsubscribe},
+		{&Publish{}, ps.handlePublish},
+	}
+	for _, h := range handlers {
+		if err := m.RegisterMessage(h.msg); err != nil {
+			return nil, err
+		}
+		if err := m.RegisterHandler(h.msg, h.h); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// AddPeer adds a peer and exchanges the subscriptions with it.
+// The peer adds this node back when it learns the subscriptions.
+func (ps *PubSub) AddPeer(hostport string) error {
+	ps.mu.Lock()
+	if _, ok := ps.peers[hostport]; !ok {
+		ps.peers[hostport] = make(map[string]bool)
+	}
+	topics := ps.topics()
+	ps.mu.Unlock()
+
+	return ps.m.Send(hostport, &Subscribe{
+		Topics:   topics,
+		Snapshot: proto.Bool(true),
+		Reply:    proto.Bool(true),
+	})
+}
+
+// RemovePeer stops publishing to the peer.
+func (ps *PubSub) RemovePeer(hostport string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.peers, hostport)
+}
+
+// Subscribe subscribes to the topic, the messages
+// published to it will be passed to the handler.
+func (ps *PubSub) Subscribe(topic string, h Handler) error {
+	ps.mu.Lock()
+	if _, ok := ps.handlers[topic]; ok {
+		ps.mu.Unlock()
+		return fmt.Errorf("Topic %q is already subscribed", topic)
+	}
+	ps.handlers[topic] = h
+	peers := ps.peerList()
+	ps.mu.Unlock()
+
+	return ps.broadcast(peers, &Subscribe{Topics: []string{topic}})
+}
+
+// Unsubscribe unsubscribes from the topic.
+func (ps *PubSub) Unsubscribe(topic string) error {
+	ps.mu.Lock()
+	if _, ok := ps.handlers[topic]; !ok {
+		ps.mu.Unlock()
+		return fmt.Errorf("Topic %q is not subscribed", topic)
+	}
+	delete(ps.handlers, topic)
+	peers := ps.peerList()
+	ps.mu.Unlock()
+
+	return ps.broadcast(peers, &Unsubscribe{Topics: []string{topic}})
+}
+
+// Subscribers returns the peers that subscribe to the topic.
+func (ps *PubSub) Subscribers(topic string) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var peers []string
+	for peer, topics := range ps.peers {
+		if topics[topic] {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Publish sends the message to all the peers that subscribe to
+// the topic. The local handler of the topic is invoked as well.
+// It returns the last error if some of the peers fail.
+func (ps *PubSub) Publish(topic string, msg interface{}) error {
+	payload, err := ps.m.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	h := ps.handlers[topic]
+	ps.mu.Unlock()
+	if h != nil {
+		h(&Message{Topic: topic, From: ps.m.Addr(), Body: msg})
+	}
+
+	return ps.broadcast(ps.Subscribers(topic), &Publish{
+		Topic:   proto.String(topic),
+		Payload: payload,
+	})
+}
+
+// Send the message to the peers.
+func (ps *PubSub) broadcast(peers []string, msg interface{}) error {
+	var lastErr error
+	for _, peer := range peers {
+		if err := ps.m.Send(peer, msg); err != nil {
+			ps.logger.Warningf("PubSub: Failed to send to %v: %v\n", peer, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// The topics subscribed locally, the caller must hold the lock.
+func (ps *PubSub) topics() []string {
+	topics := make([]string, 0, len(ps.handlers))
+	for topic := range ps.handlers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// All the peers, the caller must hold the lock.
+func (ps *PubSub) peerList() []string {
+	peers := make([]string, 0, len(ps.peers))
+	for peer := range ps.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (ps *PubSub) handleSubscribe(msg *messenger.Message) {
+	sub := msg.Body.(*Subscribe)
+
+	ps.mu.Lock()
+	topics, ok := ps.peers[msg.From]
+	if !ok || sub.GetSnapshot() {
+		topics = make(map[string]bool)
+		ps.peers[msg.From] = topics
+	}
+	for _, topic := range sub.GetTopics() {
+		topics[topic] = true
+	}
+	var local []string
+	if sub.GetReply() {
+		local = ps.topics()
+	}
+	ps.mu.Unlock()
+
+	if sub.GetReply() {
+		if err := ps.m.Send(msg.From, &Subscribe{
+			Topics:   local,
+			Snapshot: proto.Bool(true),
+		}); err != nil {
+			ps.logger.Warningf("PubSub: Failed to send to %v: %v\n", msg.From, err)
+		}
+	}
+}
+
+func (ps *PubSub) handleUnsubscribe(msg *messenger.Message) {
+	unsub := msg.Body.(*Unsubscribe)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if topics, ok := ps.peers[msg.From]; ok {
+		for _, topic := range unsub.GetTopics() {
+			delete(topics, topic)
+		}
+	}
+}
+
+func (ps *PubSub) handlePublish(msg *messenger.Message) {
+	pub := msg.Body.(*Publish)
+
+	ps.mu.Lock()
+	h := ps.handlers[pub.GetTopic()]
+	ps.mu.Unlock()
+	if h == nil {
+		ps.logger.Debugf("PubSub: Not subscribed to %q\n", pub.GetTopic())
+		return
+	}
+
+	body, err := ps.m.Unmarshal(pub.GetPayload())
+	if err != nil {
+		ps.logger.Warningf("PubSub: Failed to unmarshal the message of %q: %v\n", pub.GetTopic(), err)
+		return
+	}
+	h(&Message{Topic: pub.GetTopic(), From: msg.From, Body: body})
+}
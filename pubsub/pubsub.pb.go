@@ -0,0 +1,89 @@
+// Code generated by protoc-gen-gogo.
+// source: pubsub.proto
+// DO NOT EDIT!
+
+package pubsub
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type Subscribe struct {
+	Topics           []string `protobuf:"bytes,1,rep,name=topics" json:"topics,omitempty"`
+	Snapshot         *bool    `protobuf:"varint,2,opt,name=snapshot" json:"snapshot,omitempty"`
+	Reply            *bool    `protobuf:"varint,3,opt,name=reply" json:"reply,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Subscribe) Reset()         { *m = Subscribe{} }
+func (m *Subscribe) String() string { return proto.CompactTextString(m) }
+func (*Subscribe) ProtoMessage()    {}
+
+func (m *Subscribe) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+func (m *Subscribe) GetSnapshot() bool {
+	if m != nil && m.Snapshot != nil {
+		return *m.Snapshot
+	}
+	return false
+}
+
+func (m *Subscribe) GetReply() bool {
+	if m != nil && m.Reply != nil {
+		return *m.Reply
+	}
+	return false
+}
+
+type Unsubscribe struct {
+	Topics           []string `protobuf:"bytes,1,rep,name=topics" json:"topics,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Unsubscribe) Reset()         { *m = Unsubscribe{} }
+func (m *Unsubscribe) String() string { return proto.CompactTextString(m) }
+func (*Unsubscribe) ProtoMessage()    {}
+
+func (m *Unsubscribe) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+type Publish struct {
+	Topic            *string `protobuf:"bytes,1,req,name=topic" json:"topic,omitempty"`
+	Payload          []byte  `protobuf:"bytes,2,req,name=payload" json:"payload,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Publish) Reset()         { *m = Publish{} }
+func (m *Publish) String() string { return proto.CompactTextString(m) }
+func (*Publish) ProtoMessage()    {}
+
+func (m *Publish) GetTopic() string {
+	if m != nil && m.Topic != nil {
+		return *m.Topic
+	}
+	return ""
+}
+
+func (m *Publish) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func init() {
+}
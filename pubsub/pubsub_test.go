@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+func newPubSub(t *testing.T, network *transporter.MemoryNetwork, hostport string) (*PubSub, *messenger.Messenger) {
+	m := messenger.New(codec.NewGoGoProtobufCodec(), transporter.NewMemoryTransporter(network, hostport), false, true)
+	assert.NotNil(t, m)
+	ps, err := New(m)
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.Start())
+	return ps, m
+}
+
+// Wait until the subscribers of the topic are as expected.
+func waitSubscribers(t *testing.T, ps *PubSub, topic string, expected []string) {
+	for i := 0; i < 100; i++ {
+		if assert.ObjectsAreEqual(expected, ps.Subscribers(topic)) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Subscribers of %q are %v, expected %v", topic, ps.Subscribers(topic), expected)
+}
+
+func TestPubSub(t *testing.T) {
+	network := transporter.NewMemoryNetwork()
+	a, ma := newPubSub(t, network, "a")
+	b, mb := newPubSub(t, network, "b")
+	c, mc := newPubSub(t, network, "c")
+
+	received := make(chan *Message, 10)
+	handler := func(msg *Message) {
+		received <- msg
+	}
+
+	// Subscribe before the peers are added, should be
+	// learned from the snapshot.
+	assert.NoError(t, b.Subscribe("x", handler))
+	assert.Error(t, b.Subscribe("x", handler))
+	assert.NoError(t, a.AddPeer("b"))
+	assert.NoError(t, a.AddPeer("c"))
+	waitSubscribers(t, a, "x", []string{"b"})
+	waitSubscribers(t, b, "y", nil)
+
+	// Subscribe after the peers are added.
+	assert.NoError(t, c.Subscribe("y", handler))
+	waitSubscribers(t, a, "y", []string{"c"})
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, a.Publish("x", msg))
+	select {
+	case m := <-received:
+		assert.Equal(t, "x", m.Topic)
+		assert.Equal(t, "a", m.From)
+		assert.Equal(t, msg, m.Body)
+	case <-time.After(time.Second):
+		t.Fatal("Message is not delivered, waited 1s")
+	}
+
+	// Should be delivered to the local handler as well.
+	assert.NoError(t, a.Subscribe("z", handler))
+	assert.NoError(t, a.Publish("z", msg))
+	m := <-received
+	assert.Equal(t, "z", m.Topic)
+	assert.Equal(t, "a", m.From)
+
+	// Should stop publishing to c once it unsubscribes.
+	assert.NoError(t, c.Unsubscribe("y"))
+	assert.Error(t, c.Unsubscribe("y"))
+	waitSubscribers(t, a, "y", nil)
+	assert.NoError(t, a.Publish("y", msg))
+
+	// Should fail because the message is not registered.
+	assert.Error(t, a.Publish("x", &example.GoGoProtobufTestMessage2{}))
+
+	select {
+	case m := <-received:
+		t.Fatalf("Unexpected message %v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	assert.NoError(t, ma.Stop())
+	assert.NoError(t, mb.Stop())
+	assert.NoError(t, mc.Stop())
+}
@@ -0,0 +1,216 @@
+package messenger
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+const (
+	// The first retransmission happens after this interval,
+	// it's doubled after each retransmission.
+	initialRetransmitInterval = time.Millisecond * 100
+	// The upper bound of the retransmission interval.
+	maxRetransmitInterval = time.Second * 5
+	// How often to check for the messages to retransmit.
+	retransmitTick = time.Millisecond * 50
+	// The maximum number of out-of-order sequence numbers
+	// to remember per peer.
+	maxDedupWindow = 65536
+)
+
+// ErrNotAcknowledged is reported by SendContext() if the reliable
+// message is not acknowledged by the receiver before the deadline.
+var ErrNotAcknowledged = errors.New("Message is not acknowledged before the deadline")
+
+// Identifies an unacknowledged message.
+type unackedKey struct {
+	hostport string
+	seq      uint64
+}
+
+// A reliable message waiting for the acknowledgement.
+type unackedMessage struct {
+	key       unackedKey
+	data      []byte // The marshaled envelope.
+	deadline  time.Time
+	nextRetry time.Time
+	interval  time.Duration
+	mts       *messageToSend // For reporting the result.
+}
+
+// The sending side of the reliable delivery. Messages are numbered
+// per peer and kept until they are acknowledged or expired.
+type reliableSender struct {
+	sync.Mutex
+	epoch    uint64 // Random, so the receivers can tell the restarts.
+	deadline time.Duration
+	clock    Clock
+	lastSeq  map[string]uint64
+	unacked  map[unackedKey]*unackedMessage
+	logger   logger.Logger
+}
+
+func newReliableSender(deadline time.Duration, epoch uint64, clock Clock, l logger.Logger) *reliableSender {
+	return &reliableSender{
+		epoch:    epoch,
+		deadline: deadline,
+		clock:    clock,
+		logger:   l,
+		lastSeq:  make(map[string]uint64),
+		unacked:  make(map[unackedKey]*unackedMessage),
+	}
+}
+
+// Assign the next sequence number for the peer to the envelope,
+// and remember the marshaled envelope for retransmission.
+func (s *reliableSender) track(mts *messageToSend, e *envelope) []byte {
+	hostport := mts.hostport
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastSeq[hostport]++
+	e.epoch = s.epoch
+	e.seq = s.lastSeq[hostport]
+	data := e.marshal()
+
+	now := s.clock.Now()
+	key := unackedKey{hostport, e.seq}
+	s.unacked[key] = &unackedMessage{
+		key:       key,
+		data:      data,
+		deadline:  now.Add(s.deadline),
+		nextRetry: now.Add(initialRetransmitInterval),
+		interval:  initialRetransmitInterval,
+		mts:       mts,
+	}
+	return data
+}
+
+// Forget the message once it's acknowledged.
+func (s *reliableSender) ack(hostport string, epoch, seq uint64) {
+	if epoch != s.epoch {
+		return
+	}
+	s.Lock()
+	key := unackedKey{hostport, seq}
+	u, ok := s.unacked[key]
+	delete(s.unacked, key)
+	s.Unlock()
+
+	if ok {
+		u.mts.done(nil)
+	}
+}
+
+// Forget all the messages waiting for the acks and return them,
+// e.g. when the messenger is stopped.
+func (s *reliableSender) abandon() []*unackedMessage {
+	s.Lock()
+	defer s.Unlock()
+
+	var abandoned []*unackedMessage
+	for key, u := range s.unacked {
+		delete(s.unacked, key)
+		abandoned = append(abandoned, u)
+	}
+	return abandoned
+}
+
+// Return the messages that need to be retransmitted now,
+// and drop the ones that have passed the deadline. Both are
+// sorted by the peer and the sequence number.
+func (s *reliableSender) due(now time.Time) (resend, expired []*unackedMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	for key, u := range s.unacked {
+		if now.After(u.deadline) {
+			s.logger.Warningf("Message %d to %v is not acknowledged before the deadline, dropped\n",
+				key.seq, key.hostport)
+			delete(s.unacked, key)
+			u.mts.done(ErrNotAcknowledged)
+			expired = append(expired, u)
+			continue
+		}
+		if now.Before(u.nextRetry) {
+			continue
+		}
+		resend = append(resend, u)
+		u.interval *= 2
+		if u.interval > maxRetransmitInterval {
+			u.interval = maxRetransmitInterval
+		}
+		u.nextRetry = now.Add(u.interval)
+	}
+	sortUnacked(resend)
+	sortUnacked(expired)
+	return resend, expired
+}
+
+// Sort the messages, so they are sent in the same order in every run.
+func sortUnacked(us []*unackedMessage) {
+	sort.Slice(us, func(i, j int) bool {
+		if us[i].key.hostport != us[j].key.hostport {
+			return us[i].key.hostport < us[j].key.hostport
+		}
+		return us[i].key.seq < us[j].key.seq
+	})
+}
+
+// The dedup state of one peer.
+type dedupState struct {
+	epoch uint64
+	floor uint64          // All the seqs <= floor have been seen.
+	seen  map[uint64]bool // Seen seqs > floor.
+}
+
+// The receiving side of the reliable delivery, which drops
+// the duplicated messages.
+type reliableReceiver struct {
+	peers map[string]*dedupState
+}
+
+func newReliableReceiver() *reliableReceiver {
+	return &reliableReceiver{
+		peers: make(map[string]*dedupState),
+	}
+}
+
+// Return true if the message has been seen before. The state is reset
+// whenever the epoch changes, since the epochs are random and cannot
+// tell which incarnation is newer. Only called in the incomingLoop,
+// so no lock is needed.
+func (r *reliableReceiver) isDuplicate(hostport string, epoch, seq uint64) bool {
+	d, ok := r.peers[hostport]
+	if !ok || epoch != d.epoch {
+		// The peer is new or restarted.
+		d = &dedupState{epoch: epoch, seen: make(map[uint64]bool)}
+		r.peers[hostport] = d
+	}
+	if seq <= d.floor || d.seen[seq] {
+		return true
+	}
+	d.seen[seq] = true
+
+	if len(d.seen) > maxDedupWindow {
+		// Some messages never arrive, they must have been
+		// expired on the sender, so skip the gap.
+		min := seq
+		for s := range d.seen {
+			if s < min {
+				min = s
+			}
+		}
+		d.floor = min - 1
+	}
+	for d.seen[d.floor+1] {
+		delete(d.seen, d.floor+1)
+		d.floor++
+	}
+	return false
+}
@@ -0,0 +1,436 @@
+// Package simulation provides a deterministic in-process network for
+// testing distributed algorithms. Messages are not delivered when they
+// are sent, but when the network is stepped, in the order of a virtual
+// clock. The latency, loss and duplication of every message are drawn
+// from a random source derived from the seed, the link and the index
+// of the message on the link, so a run can be replayed from the seed.
+// The replay is exact as long as the nodes send in the same order
+// between the steps, which is the case when a single goroutine drives
+// the transporters; nodes running in their own goroutines, like the
+// messengers, need AddNode() to let them react before the next step.
+package simulation
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Node is a program running in its own goroutines on the network,
+// like a messenger, which can tell if it's done reacting.
+type Node interface {
+	// Idle returns true if the node has nothing to do
+	// until the next message or timer.
+	Idle() bool
+}
+
+// How long a step waits for the nodes to be idle at most,
+// in case some node never takes its messages.
+const settleTimeout = time.Second * 5
+
+// How often a step checks whether the nodes are idle.
+const settlePoll = time.Millisecond / 10
+
+// LinkConfig describes the behaviour of a link.
+type LinkConfig struct {
+	// The minimum delay of a message.
+	Latency time.Duration
+	// A random delay up to the jitter is added to the latency,
+	// so the messages can be reordered.
+	Jitter time.Duration
+	// The probability that a message is lost.
+	LossRate float64
+	// The probability that a message is delivered twice.
+	DuplicateRate float64
+}
+
+// Delivery is a message delivered by the network.
+type Delivery struct {
+	At   time.Time
+	From string
+	To   string
+	Data []byte
+}
+
+// A directed link.
+type link struct {
+	from, to string
+}
+
+// A message or a timer scheduled on the virtual clock.
+type event struct {
+	at    time.Time
+	link  link
+	index uint64 // The index on the link, or of the timer.
+	copy  int    // Non-zero for the duplicates.
+	data  []byte
+	timer chan time.Time // Non-nil for the timers of After().
+	fn    func()         // Non-nil for the timers of AfterFunc().
+}
+
+// The events are ordered by the time, the ties are broken
+// by the link and the index, so the order is deterministic.
+func (e *event) before(o *event) bool {
+	if !e.at.Equal(o.at) {
+		return e.at.Before(o.at)
+	}
+	if e.link.from != o.link.from {
+		return e.link.from < o.link.from
+	}
+	if e.link.to != o.link.to {
+		return e.link.to < o.link.to
+	}
+	if e.index != o.index {
+		return e.index < o.index
+	}
+	return e.copy < o.copy
+}
+
+type eventHeap []*event
+
+func (h eventHeap) Len() int            { return len(h) }
+func (h eventHeap) Less(i, j int) bool  { return h[i].before(h[j]) }
+func (h eventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(*event)) }
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Network is a simulated network driven by a virtual clock.
+type Network struct {
+	seed int64
+
+	mu          sync.Mutex
+	now         time.Time
+	events      eventHeap
+	nodes       map[string]*Transporter
+	running     []Node       // Waited for before each step.
+	delivered   *Transporter // The receiver of the last step.
+	defaultLink LinkConfig
+	links       map[link]LinkConfig
+	blocked     map[link]bool
+	sent        map[link]uint64 // The number of messages sent on each link.
+	timers      uint64
+	trace       []Delivery
+	dropped     int
+}
+
+// The virtual time where every network starts.
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NewNetwork creates a network, all the random
+// decisions are derived from the seed.
+func NewNetwork(seed int64, opts ...Option) *Network {
+	o := newOptions(opts)
+	return &Network{
+		seed:        seed,
+		now:         epoch,
+		nodes:       make(map[string]*Transporter),
+		defaultLink: o.defaultLink,
+		links:       make(map[link]LinkConfig),
+		blocked:     make(map[link]bool),
+		sent:        make(map[link]uint64),
+	}
+}
+
+// AddNode makes every step wait until the node is idle, and the
+// receiver of the last step has taken the message, so the messages
+// the nodes send in response are stamped with the current virtual
+// time. The goroutines outside the nodes are not waited for, e.g.
+// the callers of messenger.Call(), and neither are the timers of
+// After(), use AfterFunc() for the replay to be exact.
+func (n *Network) AddNode(node Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.running = append(n.running, node)
+}
+
+// Seed returns the seed of the network.
+func (n *Network) Seed() int64 {
+	return n.seed
+}
+
+// SetLink sets the behaviour of the link from one node to another.
+func (n *Network) SetLink(from, to string, cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[link{from, to}] = cfg
+}
+
+// SetDefaultLink sets the behaviour of the links that are not set.
+func (n *Network) SetDefaultLink(cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaultLink = cfg
+}
+
+// Block drops the messages from one node to another,
+// including the ones in flight.
+func (n *Network) Block(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocked[link{from, to}] = true
+}
+
+// Unblock lets the messages from one node to another pass again.
+func (n *Network) Unblock(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.blocked, link{from, to})
+}
+
+// Partition blocks the links between the nodes of different groups
+// in both directions, the links within a group are not changed.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := range groups {
+		for j := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range groups[i] {
+				for _, to := range groups[j] {
+					n.blocked[link{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Heal unblocks all the links.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocked = make(map[link]bool)
+}
+
+// Now returns the virtual time.
+func (n *Network) Now() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now
+}
+
+// After returns a channel that receives the virtual time once
+// the network is stepped past the duration, so the network can
+// be used as the clock of the nodes.
+func (n *Network) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	n.schedule(d, &event{timer: c})
+	return c
+}
+
+// AfterFunc calls the f in the goroutine stepping the network once
+// it's stepped past the duration, so the network can be used as the
+// clock of the messengers, see messenger.WithClock().
+func (n *Network) AfterFunc(d time.Duration, f func()) {
+	n.schedule(d, &event{fn: f})
+}
+
+// Schedule a timer after the duration.
+func (n *Network) schedule(d time.Duration, e *event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.timers++
+	e.at = n.now.Add(d)
+	e.index = n.timers
+	heap.Push(&n.events, e)
+}
+
+// Pending returns the number of the scheduled messages and timers.
+func (n *Network) Pending() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.events)
+}
+
+// Trace returns the messages delivered so far in order.
+// Two runs of the same program with the same seed have the same trace.
+func (n *Network) Trace() []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Delivery(nil), n.trace...)
+}
+
+// Dropped returns the number of the messages that are lost,
+// blocked, or sent to the nodes that are not listening.
+func (n *Network) Dropped() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dropped
+}
+
+// Step waits for the nodes to react to the last event, then
+// advances the virtual clock to the next event and fires it.
+// It returns false if there is no event left.
+func (n *Network) Step() bool {
+	n.settle()
+	return n.step()
+}
+
+func (n *Network) step() bool {
+	n.mu.Lock()
+	if len(n.events) == 0 {
+		n.mu.Unlock()
+		return false
+	}
+	e := heap.Pop(&n.events).(*event)
+	n.now = e.at
+	if e.timer != nil {
+		e.timer <- e.at
+		n.mu.Unlock()
+		return true
+	}
+	if e.fn != nil {
+		n.mu.Unlock()
+		e.fn()
+		return true
+	}
+	dst, ok := n.nodes[e.link.to]
+	if !ok || n.blocked[e.link] || !dst.deliver(e.link.from, e.data) {
+		n.dropped++
+		n.mu.Unlock()
+		return true
+	}
+	n.trace = append(n.trace, Delivery{e.at, e.link.from, e.link.to, e.data})
+	n.delivered = dst
+	n.mu.Unlock()
+	return true
+}
+
+// Run steps the network until there is no event left,
+// or the limit of steps is reached. It returns the steps.
+func (n *Network) Run(limit int) int {
+	steps := 0
+	for steps < limit && n.Step() {
+		steps++
+	}
+	return steps
+}
+
+// RunFor steps the network through the events of the duration,
+// and advances the virtual clock by the duration.
+func (n *Network) RunFor(d time.Duration) {
+	n.mu.Lock()
+	end := n.now.Add(d)
+	n.mu.Unlock()
+
+	for {
+		n.settle()
+		n.mu.Lock()
+		if len(n.events) == 0 || n.events[0].at.After(end) {
+			n.now = end
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+		n.step()
+	}
+}
+
+// Wait for the nodes to react to the last event, so the messages
+// they send in response are stamped with the current virtual time.
+// It doesn't depend on how long the nodes take, but on whether they
+// are idle, so the replay is exact.
+func (n *Network) settle() {
+	n.mu.Lock()
+	running := n.running
+	dst := n.delivered
+	n.delivered = nil
+	n.mu.Unlock()
+	if len(running) == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(settleTimeout)
+	for time.Now().Before(deadline) {
+		idle := dst == nil || dst.idle()
+		for _, node := range running {
+			idle = idle && node.Idle()
+		}
+		if idle {
+			return
+		}
+		time.Sleep(settlePoll)
+	}
+}
+
+// Attach a transporter to the network.
+func (n *Network) attach(t *Transporter) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[t.hostport]; ok {
+		return fmt.Errorf("Address %v is already in use", t.hostport)
+	}
+	n.nodes[t.hostport] = t
+	return nil
+}
+
+// Detach a transporter from the network.
+func (n *Network) detach(t *Transporter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nodes[t.hostport] == t {
+		delete(n.nodes, t.hostport)
+	}
+}
+
+// The random source of a message, which only depends on the
+// seed, the link and the index of the message on the link.
+func (n *Network) randFor(l link, index uint64) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%s|%s|%d", n.seed, l.from, l.to, index)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// Schedule the delivery of a message.
+func (n *Network) send(from, to string, b []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[to]; !ok {
+		return fmt.Errorf("Unknown address %v", to)
+	}
+
+	l := link{from, to}
+	n.sent[l]++
+	index := n.sent[l]
+	cfg, ok := n.links[l]
+	if !ok {
+		cfg = n.defaultLink
+	}
+
+	// Always draw the same numbers, so the decisions of a message
+	// don't depend on the config of the others.
+	r := n.randFor(l, index)
+	lost := r.Float64() < cfg.LossRate
+	duplicated := r.Float64() < cfg.DuplicateRate
+	delays := [2]time.Duration{cfg.Latency, cfg.Latency}
+	if cfg.Jitter > 0 {
+		delays[0] += time.Duration(r.Int63n(int64(cfg.Jitter)))
+		delays[1] += time.Duration(r.Int63n(int64(cfg.Jitter)))
+	}
+
+	if lost || n.blocked[l] {
+		n.dropped++
+		return nil
+	}
+	// Copy the bytes so the sender can reuse the buffer.
+	data := make([]byte, len(b))
+	copy(data, b)
+	heap.Push(&n.events, &event{at: n.now.Add(delays[0]), link: l, index: index, data: data})
+	if duplicated {
+		heap.Push(&n.events, &event{at: n.now.Add(delays[1]), link: l, index: index, copy: 1, data: data})
+	}
+	return nil
+}
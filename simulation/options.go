@@ -0,0 +1,29 @@
+package simulation
+
+// The configurable settings of a network.
+type options struct {
+	defaultLink LinkConfig
+}
+
+func defaultOptions() *options {
+	return &options{}
+}
+
+func newOptions(opts []Option) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Option configures a network, see NewNetwork().
+type Option func(*options)
+
+// WithDefaultLink sets the behaviour of the links,
+// which deliver at once without any fault by default.
+func WithDefaultLink(cfg LinkConfig) Option {
+	return func(o *options) {
+		o.defaultLink = cfg
+	}
+}
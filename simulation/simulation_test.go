@@ -0,0 +1,221 @@
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+func newTransporters(t *testing.T, n *Network, addrs ...string) []*Transporter {
+	var trs []*Transporter
+	for _, addr := range addrs {
+		tr := NewTransporter(n, addr)
+		assert.NoError(t, tr.Listen())
+		trs = append(trs, tr)
+	}
+	return trs
+}
+
+// Run a ping-pong cluster from a single goroutine, return the trace.
+func runCluster(t *testing.T, seed int64) []Delivery {
+	n := NewNetwork(seed, WithDefaultLink(LinkConfig{
+		Latency:       time.Millisecond * 10,
+		Jitter:        time.Millisecond * 50,
+		LossRate:      0.1,
+		DuplicateRate: 0.1,
+	}))
+	trs := newTransporters(t, n, "a", "b", "c")
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, trs[0].Send("b", []byte(fmt.Sprintf("ping%d", i))))
+		assert.NoError(t, trs[0].Send("c", []byte(fmt.Sprintf("ping%d", i))))
+	}
+	for n.Step() {
+		// The peers of a reply to every ping.
+		for _, tr := range trs {
+			for len(tr.inbox) > 0 {
+				from, b, err := tr.RecvFrom()
+				assert.NoError(t, err)
+				if tr.Addr() != "a" {
+					assert.NoError(t, tr.Send(from, append([]byte("re:"), b...)))
+				}
+			}
+		}
+	}
+	assert.NotEqual(t, 0, n.Dropped())
+	return n.Trace()
+}
+
+func TestReplay(t *testing.T) {
+	trace := runCluster(t, 1)
+	assert.NotEmpty(t, trace)
+	assert.Equal(t, trace, runCluster(t, 1))
+	assert.NotEqual(t, trace, runCluster(t, 2))
+
+	// Should be reordered by the jitter.
+	reordered := false
+	for i := 1; i < len(trace); i++ {
+		if trace[i].From == "a" && trace[i].To == "b" && trace[i-1].From == "a" && trace[i-1].To == "b" &&
+			string(trace[i].Data) < string(trace[i-1].Data) {
+			reordered = true
+		}
+	}
+	assert.True(t, reordered)
+}
+
+func TestPartition(t *testing.T) {
+	n := NewNetwork(1)
+	trs := newTransporters(t, n, "a", "b", "c")
+
+	n.Partition([]string{"a"}, []string{"b", "c"})
+	assert.NoError(t, trs[0].Send("b", []byte("hello")))
+	assert.NoError(t, trs[1].Send("a", []byte("hello")))
+	assert.NoError(t, trs[1].Send("c", []byte("hello")))
+	assert.Equal(t, 1, n.Run(100))
+	assert.Equal(t, 2, n.Dropped())
+	assert.Equal(t, []Delivery{{n.Now(), "b", "c", []byte("hello")}}, n.Trace())
+
+	// Should drop the messages in flight.
+	n.Heal()
+	assert.NoError(t, trs[0].Send("b", []byte("hello")))
+	n.Block("a", "b")
+	assert.Equal(t, 1, n.Run(100))
+	assert.Equal(t, 3, n.Dropped())
+
+	// Should only block one direction.
+	assert.NoError(t, trs[1].Send("a", []byte("hello")))
+	assert.Equal(t, 1, n.Run(100))
+	assert.Equal(t, 3, n.Dropped())
+	n.Unblock("a", "b")
+	assert.NoError(t, trs[0].Send("b", []byte("hello")))
+	n.Run(100)
+	assert.Equal(t, 3, n.Dropped())
+
+	// Should fail if nothing listens on the address.
+	assert.Error(t, trs[0].Send("unknown", []byte("hello")))
+	assert.NoError(t, trs[2].Stop())
+	assert.Error(t, trs[0].Send("c", []byte("hello")))
+}
+
+func TestVirtualClock(t *testing.T) {
+	n := NewNetwork(1, WithDefaultLink(LinkConfig{Latency: time.Second}))
+	trs := newTransporters(t, n, "a", "b")
+	start := n.Now()
+
+	timer := n.After(time.Millisecond * 500)
+	assert.NoError(t, trs[0].Send("b", []byte("hello")))
+	assert.Equal(t, 2, n.Pending())
+
+	assert.True(t, n.Step())
+	assert.Equal(t, start.Add(time.Millisecond*500), <-timer)
+	assert.Equal(t, 0, len(trs[1].inbox))
+
+	n.RunFor(time.Second)
+	assert.Equal(t, start.Add(time.Millisecond*1500), n.Now())
+	assert.Equal(t, 1, len(trs[1].inbox))
+	assert.False(t, n.Step())
+}
+
+// Messengers running on the simulated network.
+func TestMessenger(t *testing.T) {
+	n := NewNetwork(1, WithDefaultLink(LinkConfig{
+		Latency: time.Millisecond,
+		Jitter:  time.Millisecond * 10,
+	}))
+
+	var received int32
+	newMessenger := func(addr string) *messenger.Messenger {
+		m := messenger.New(codec.NewGoGoProtobufCodec(), NewTransporter(n, addr), false, true,
+			messenger.WithClock(n))
+		assert.NotNil(t, m)
+		assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *messenger.Message) {
+			atomic.AddInt32(&received, 1)
+		}))
+		assert.NoError(t, m.Start())
+		n.AddNode(m)
+		return m
+	}
+	client := newMessenger("client")
+	server := newMessenger("server")
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, client.Send("server", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i)),
+			F1: proto.String("hello"),
+			F2: proto.Float32(4.2),
+		}))
+	}
+	// Should wait for the messages to be sent and handled.
+	assert.Equal(t, 10, n.Run(100))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&received))
+
+	assert.NoError(t, client.Stop())
+	assert.NoError(t, server.Stop())
+}
+
+// Run a cluster of reliable messengers on a lossy network, where
+// each node forwards the pings to the next one, return the trace.
+func runMessengers(t *testing.T, seed int64) []Delivery {
+	n := NewNetwork(seed, WithDefaultLink(LinkConfig{
+		Latency:       time.Millisecond * 10,
+		Jitter:        time.Millisecond * 50,
+		LossRate:      0.2,
+		DuplicateRate: 0.1,
+	}))
+
+	addrs := []string{"a", "b", "c"}
+	var nodes []*messenger.Messenger
+	for i, addr := range addrs {
+		ids := rand.New(rand.NewSource(seed + int64(i)))
+		m := messenger.New(codec.NewGoGoProtobufCodec(), NewTransporter(n, addr), false, true,
+			messenger.WithReliable(time.Minute), messenger.WithClock(n), messenger.WithIDSource(ids.Uint64))
+		assert.NotNil(t, m)
+		assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		next := addrs[(i+1)%len(addrs)]
+		assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg *messenger.Message) {
+			hops := msg.Body.(*example.GoGoProtobufTestMessage1).GetF0()
+			if hops > 0 {
+				assert.NoError(t, m.Send(next, &example.GoGoProtobufTestMessage1{
+					F0: proto.Int32(hops - 1),
+					F1: proto.String(msg.From),
+					F2: proto.Float32(4.2),
+				}))
+			}
+		}))
+		assert.NoError(t, m.Start())
+		n.AddNode(m)
+		nodes = append(nodes, m)
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, nodes[0].Send("b", &example.GoGoProtobufTestMessage1{
+			F0: proto.Int32(int32(i * 3)),
+			F1: proto.String("a"),
+			F2: proto.Float32(4.2),
+		}))
+	}
+	n.RunFor(time.Second * 30)
+
+	for _, m := range nodes {
+		assert.Equal(t, int64(0), m.Stats().Dropped)
+		assert.NoError(t, m.Stop())
+	}
+	assert.NotEqual(t, 0, n.Dropped())
+	return n.Trace()
+}
+
+func TestReplayMessengers(t *testing.T) {
+	trace := runMessengers(t, 1)
+	assert.NotEmpty(t, trace)
+	assert.Equal(t, trace, runMessengers(t, 1))
+	assert.NotEqual(t, trace, runMessengers(t, 2))
+}
@@ -0,0 +1,170 @@
+package simulation
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// The size of the inbox of a transporter, the messages
+// delivered to a full inbox are dropped.
+const inboxSize = 1024
+
+// A message in the inbox.
+type message struct {
+	from string
+	data []byte
+}
+
+// Transporter implements the transporter.Transporter atop a
+// simulated Network. Send() only schedules the message, which
+// is delivered when the network is stepped.
+type Transporter struct {
+	hostport string // Local address.
+	network  *Network
+	inbox    chan *message
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	started bool
+	stopped bool
+	waiting bool // Blocked in RecvFrom().
+	unread  int  // The delivered messages not returned by RecvFrom() yet.
+}
+
+// NewTransporter creates a transporter that will be attached
+// to the network at the host:port once started.
+func NewTransporter(network *Network, hostport string) *Transporter {
+	return &Transporter{
+		hostport: hostport,
+		network:  network,
+		inbox:    make(chan *message, inboxSize),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Send schedules the message to the host:port on the network.
+// It fails if nothing listens on the address, the lost and the
+// blocked messages are dropped silently.
+func (t *Transporter) Send(hostport string, b []byte) error {
+	return t.network.send(t.hostport, hostport, b)
+}
+
+// Recv receives a message in bytes from some peer.
+func (t *Transporter) Recv() (b []byte, err error) {
+	_, b, err = t.RecvFrom()
+	return b, err
+}
+
+// RecvFrom receives a message in bytes from some peer,
+// along with the address of the peer.
+// It returns ErrStopped once the transporter is stopped.
+func (t *Transporter) RecvFrom() (hostport string, b []byte, err error) {
+	t.setWaiting(true)
+	select {
+	case msg := <-t.inbox:
+		t.mu.Lock()
+		t.waiting = false
+		t.unread--
+		t.mu.Unlock()
+		return msg.from, msg.data, nil
+	case <-t.stop:
+		t.setWaiting(false)
+		return "", nil, transporter.ErrStopped
+	}
+}
+
+// Addr returns the local address.
+func (t *Transporter) Addr() string {
+	return t.hostport
+}
+
+// Listen attaches the transporter to the network, it fails
+// if the address is already in use.
+func (t *Transporter) Listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started || t.stopped {
+		return fmt.Errorf("Transporter cannot be started again")
+	}
+	if err := t.network.attach(t); err != nil {
+		return err
+	}
+	t.started = true
+	return nil
+}
+
+// Serve blocks until the transporter is stopped, the messages
+// are delivered by the network.
+func (t *Transporter) Serve() error {
+	t.mu.Lock()
+	started := t.started
+	t.mu.Unlock()
+
+	if !started {
+		return fmt.Errorf("Transporter is not listening")
+	}
+	<-t.stop
+	return nil
+}
+
+// Start the transporter, this will block until it's stopped
+// or the address is already in use.
+func (t *Transporter) Start() error {
+	if err := t.Listen(); err != nil {
+		return err
+	}
+	return t.Serve()
+}
+
+// Stop the transporter, detach it from the network.
+func (t *Transporter) Stop() error {
+	t.mu.Lock()
+	stopped := t.stopped
+	if !stopped {
+		close(t.stop)
+		t.stopped = true
+	}
+	t.mu.Unlock()
+
+	// Not under the lock, the network delivers under its own lock.
+	if !stopped {
+		t.network.detach(t)
+	}
+	return nil
+}
+
+// Destroy the transporter.
+func (t *Transporter) Destroy() error {
+	return nil
+}
+
+// Put the message into the inbox, return false if it's full.
+func (t *Transporter) deliver(from string, data []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case t.inbox <- &message{from, data}:
+		t.unread++
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Transporter) setWaiting(waiting bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waiting = waiting
+}
+
+// Return true if the delivered messages are all taken, and the
+// receiver is back waiting for the next one, or it's stopped.
+func (t *Transporter) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopped || t.waiting && t.unread == 0
+}
@@ -0,0 +1,241 @@
+package messenger
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// The upper bounds of the buckets of the latency histograms,
+// the last bucket holds everything above.
+var latencyBuckets = []time.Duration{
+	time.Microsecond * 100,
+	time.Millisecond,
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+	time.Second * 10,
+}
+
+// LatencyHistogram is a snapshot of the distribution of latencies.
+type LatencyHistogram struct {
+	// The upper bounds of the buckets, the last bucket
+	// in Counts holds the samples above all the bounds.
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// Mean returns the average latency.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		Bounds: latencyBuckets,
+		Counts: make([]int64, len(latencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h *LatencyHistogram) clone() *LatencyHistogram {
+	c := *h
+	c.Counts = append([]int64(nil), h.Counts...)
+	return &c
+}
+
+// Stats is a snapshot of the statistics of a messenger.
+// The per type maps are keyed by the Go type of the messages.
+type Stats struct {
+	Sent            map[string]int64
+	Received        map[string]int64
+	Dropped         int64
+	MarshalErrors   int64
+	UnmarshalErrors int64
+	TransportErrors int64
+	HandlerPanics   int64
+	InQueueDepth    int
+	OutQueueDepth   int
+	RecvQueueDepth  int
+	HandlerLatency  map[string]*LatencyHistogram
+	// The per peer counters of the transporter, nil if the
+	// transporter does not implement transporter.StatsReporter.
+	Peers map[string]transporter.PeerStats
+}
+
+// The statistics collected by the messenger,
+// which are forwarded to the metrics sink as well.
+type stats struct {
+	sync.Mutex
+	sink            MetricsSink
+	sent            map[string]int64
+	received        map[string]int64
+	dropped         int64
+	marshalErrors   int64
+	unmarshalErrors int64
+	transportErrors int64
+	handlerPanics   int64
+	handlerLatency  map[string]*LatencyHistogram
+}
+
+func newStats(sink MetricsSink) *stats {
+	return &stats{
+		sink:           sink,
+		sent:           make(map[string]int64),
+		received:       make(map[string]int64),
+		handlerLatency: make(map[string]*LatencyHistogram),
+	}
+}
+
+func (s *stats) incr(counter *int64, name string) {
+	s.Lock()
+	*counter++
+	s.Unlock()
+	s.sink.IncrCounter(name, 1)
+}
+
+func (s *stats) recordSent(msgType string) {
+	s.Lock()
+	s.sent[msgType]++
+	s.Unlock()
+	s.sink.IncrCounter(MetricSent, 1)
+}
+
+func (s *stats) recordReceived(msgType string) {
+	s.Lock()
+	s.received[msgType]++
+	s.Unlock()
+	s.sink.IncrCounter(MetricReceived, 1)
+}
+
+func (s *stats) recordDropped()              { s.incr(&s.dropped, MetricDropped) }
+func (s *stats) recordMarshalError()         { s.incr(&s.marshalErrors, MetricMarshalErrors) }
+func (s *stats) recordUnmarshalError()       { s.incr(&s.unmarshalErrors, MetricUnmarshalErrors) }
+func (s *stats) recordTransportError()       { s.incr(&s.transportErrors, MetricTransportErrors) }
+func (s *stats) recordPanic()                { s.incr(&s.handlerPanics, MetricHandlerPanics) }
+func (s *stats) setGauge(name string, v int) { s.sink.SetGauge(name, int64(v)) }
+
+func (s *stats) recordLatency(msgType string, d time.Duration) {
+	s.Lock()
+	h, ok := s.handlerLatency[msgType]
+	if !ok {
+		h = newLatencyHistogram()
+		s.handlerLatency[msgType] = h
+	}
+	h.observe(d)
+	s.Unlock()
+	s.sink.ObserveLatency(MetricHandlerLatency, d)
+}
+
+func (s *stats) snapshot() *Stats {
+	s.Lock()
+	defer s.Unlock()
+
+	st := &Stats{
+		Sent:            make(map[string]int64),
+		Received:        make(map[string]int64),
+		Dropped:         s.dropped,
+		MarshalErrors:   s.marshalErrors,
+		UnmarshalErrors: s.unmarshalErrors,
+		TransportErrors: s.transportErrors,
+		HandlerPanics:   s.handlerPanics,
+		HandlerLatency:  make(map[string]*LatencyHistogram),
+	}
+	for k, v := range s.sent {
+		st.Sent[k] = v
+	}
+	for k, v := range s.received {
+		st.Received[k] = v
+	}
+	for k, v := range s.handlerLatency {
+		st.HandlerLatency[k] = v.clone()
+	}
+	return st
+}
+
+// Stats returns a snapshot of the statistics of the messenger.
+func (m *Messenger) Stats() *Stats {
+	st := m.stats.snapshot()
+	st.InQueueDepth = len(m.inQueue)
+	st.OutQueueDepth = len(m.outQueue)
+	st.RecvQueueDepth = len(m.recvQueue)
+	if r, ok := m.tr.(transporter.StatsReporter); ok {
+		st.Peers = r.Stats()
+	}
+	return st
+}
+
+// Serializes the checks of the names of the expvar variables.
+var publishLock sync.Mutex
+
+// PublishExpvar exports the Stats() of the messenger as an expvar
+// variable with the name, so it's served at /debug/vars.
+// It fails if the name is already used.
+func PublishExpvar(name string, m *Messenger) error {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("Expvar %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Stats()
+	}))
+	return nil
+}
+
+// ExpvarSink is a MetricsSink that exports the metrics as
+// an expvar map, the latencies are exported as the total
+// nanoseconds and the number of samples.
+type ExpvarSink struct {
+	m *expvar.Map
+}
+
+// NewExpvarSink creates a sink that publishes the metrics
+// under the name. It fails if the name is already used.
+func NewExpvarSink(name string) (*ExpvarSink, error) {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+
+	if expvar.Get(name) != nil {
+		return nil, fmt.Errorf("Expvar %q is already published", name)
+	}
+	m := new(expvar.Map).Init()
+	expvar.Publish(name, m)
+	return &ExpvarSink{m: m}, nil
+}
+
+// IncrCounter adds the delta to the counter.
+func (e *ExpvarSink) IncrCounter(name string, delta int64) {
+	e.m.Add(name, delta)
+}
+
+// SetGauge sets the current value of the gauge.
+func (e *ExpvarSink) SetGauge(name string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	e.m.Set(name, v)
+}
+
+// ObserveLatency records a sample of the latency.
+func (e *ExpvarSink) ObserveLatency(name string, d time.Duration) {
+	e.m.Add(name+".count", 1)
+	e.m.Add(name+".total_ns", int64(d))
+}
@@ -0,0 +1,245 @@
+package transporter
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// Faults describes the faults a FaultyTransporter injects into
+// the outgoing messages. The rates are probabilities in [0, 1].
+type Faults struct {
+	// The probability that a message is dropped silently.
+	DropRate float64
+	// The delay of every message. The delayed messages are sent in
+	// the background, so Send() doesn't wait for them, and the
+	// jitter can reorder them.
+	Latency time.Duration
+	// A random delay up to the jitter is added to the latency.
+	Jitter time.Duration
+	// The probability that a message is sent twice.
+	DuplicateRate float64
+	// The probability that a random byte of a message is flipped.
+	CorruptRate float64
+}
+
+// FaultCounts are the numbers of the injected faults.
+type FaultCounts struct {
+	Dropped    int64
+	Duplicated int64
+	Corrupted  int64
+	Blocked    int64
+}
+
+// FaultyTransporter wraps a transporter and injects faults,
+// so the tests can exercise the error paths over real sockets.
+// The faults and the partitions can be changed at runtime.
+type FaultyTransporter struct {
+	tr     Transporter
+	logger logger.Logger
+
+	mu         sync.Mutex
+	faults     Faults
+	rand       *rand.Rand
+	blockedOut map[string]bool
+	blockedIn  map[string]bool
+	counts     FaultCounts
+}
+
+// NewFaultyTransporter wraps the transporter with the faults.
+func NewFaultyTransporter(tr Transporter, faults Faults, opts ...Option) *FaultyTransporter {
+	o := newOptions(opts)
+	return &FaultyTransporter{
+		tr:         tr,
+		logger:     o.logger,
+		faults:     faults,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		blockedOut: make(map[string]bool),
+		blockedIn:  make(map[string]bool),
+	}
+}
+
+// SetFaults changes the faults.
+func (t *FaultyTransporter) SetFaults(faults Faults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults = faults
+}
+
+// SetSeed reseeds the random source of the faults.
+func (t *FaultyTransporter) SetSeed(seed int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rand = rand.New(rand.NewSource(seed))
+}
+
+// BlockOutbound drops the messages sent to the host:port.
+func (t *FaultyTransporter) BlockOutbound(hostport string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockedOut[hostport] = true
+}
+
+// BlockInbound drops the messages received from the host:port.
+func (t *FaultyTransporter) BlockInbound(hostport string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockedIn[hostport] = true
+}
+
+// Unblock lets the messages to and from the host:port pass again.
+func (t *FaultyTransporter) Unblock(hostport string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.blockedOut, hostport)
+	delete(t.blockedIn, hostport)
+}
+
+// Heal unblocks all the peers.
+func (t *FaultyTransporter) Heal() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blockedOut = make(map[string]bool)
+	t.blockedIn = make(map[string]bool)
+}
+
+// Injected returns the numbers of the injected faults.
+func (t *FaultyTransporter) Injected() FaultCounts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts
+}
+
+// Send an encoded message to the host:port with the faults.
+// The dropped and the blocked messages are reported as sent,
+// and so are the delayed ones, their errors are logged.
+func (t *FaultyTransporter) Send(hostport string, b []byte) error {
+	t.mu.Lock()
+	f := t.faults
+	if t.blockedOut[hostport] {
+		t.counts.Blocked++
+		t.mu.Unlock()
+		return nil
+	}
+	if t.rand.Float64() < f.DropRate {
+		t.counts.Dropped++
+		t.mu.Unlock()
+		t.logger.Debugf("FaultyTransporter: Dropped message to %v\n", hostport)
+		return nil
+	}
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(t.rand.Int63n(int64(f.Jitter)))
+	}
+	duplicated := t.rand.Float64() < f.DuplicateRate
+	if duplicated {
+		t.counts.Duplicated++
+	}
+	if len(b) > 0 && t.rand.Float64() < f.CorruptRate {
+		t.counts.Corrupted++
+		corrupted := make([]byte, len(b))
+		copy(corrupted, b)
+		corrupted[t.rand.Intn(len(b))] ^= byte(t.rand.Intn(255) + 1)
+		b = corrupted
+	}
+	t.mu.Unlock()
+
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			if err := t.send(hostport, b, duplicated); err != nil {
+				t.logger.Warningf("FaultyTransporter: Failed to send delayed message to %v: %v\n", hostport, err)
+			}
+		})
+		return nil
+	}
+	return t.send(hostport, b, duplicated)
+}
+
+// Send the message by the wrapped transporter, twice if it's duplicated.
+func (t *FaultyTransporter) send(hostport string, b []byte, duplicated bool) error {
+	if err := t.tr.Send(hostport, b); err != nil {
+		return err
+	}
+	if duplicated {
+		return t.tr.Send(hostport, b)
+	}
+	return nil
+}
+
+// Recv receives a message in bytes from some peer.
+func (t *FaultyTransporter) Recv() (b []byte, err error) {
+	_, b, err = t.RecvFrom()
+	return b, err
+}
+
+// RecvFrom receives a message in bytes from some peer,
+// the messages from the blocked peers are dropped.
+func (t *FaultyTransporter) RecvFrom() (hostport string, b []byte, err error) {
+	hostport, b, _, err = t.RecvFromPeer()
+	return hostport, b, err
+}
+
+// RecvFromPeer is RecvFrom along with the identity of the peer,
+// if the wrapped transporter can authenticate the peers.
+func (t *FaultyTransporter) RecvFromPeer() (hostport string, b []byte, peer *PeerInfo, err error) {
+	for {
+		if r, ok := t.tr.(PeerReceiver); ok {
+			hostport, b, peer, err = r.RecvFromPeer()
+		} else {
+			hostport, b, err = t.tr.RecvFrom()
+		}
+		if err != nil {
+			return hostport, b, peer, err
+		}
+		t.mu.Lock()
+		blocked := t.blockedIn[hostport]
+		if blocked {
+			t.counts.Blocked++
+		}
+		t.mu.Unlock()
+		if !blocked {
+			return hostport, b, peer, nil
+		}
+	}
+}
+
+// Addr returns the local address.
+func (t *FaultyTransporter) Addr() string {
+	return t.tr.Addr()
+}
+
+// Listen binds the local address.
+func (t *FaultyTransporter) Listen() error {
+	return t.tr.Listen()
+}
+
+// Serve serves the incoming messages.
+func (t *FaultyTransporter) Serve() error {
+	return t.tr.Serve()
+}
+
+// Start the transporter.
+func (t *FaultyTransporter) Start() error {
+	return t.tr.Start()
+}
+
+// Stop the transporter.
+func (t *FaultyTransporter) Stop() error {
+	return t.tr.Stop()
+}
+
+// Destroy the transporter.
+func (t *FaultyTransporter) Destroy() error {
+	return t.tr.Destroy()
+}
+
+// Stats returns the counters of the wrapped transporter,
+// or nil if it doesn't count the traffic.
+func (t *FaultyTransporter) Stats() map[string]PeerStats {
+	if r, ok := t.tr.(StatsReporter); ok {
+		return r.Stats()
+	}
+	return nil
+}
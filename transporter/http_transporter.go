@@ -2,72 +2,215 @@ package transporter
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
-	log "github.com/golang/glog"
+	"github.com/go-distributed/messenger/logger"
 )
 
 // For internal message passing.
 type message struct {
+	from string // The address the sender listens on.
 	data []byte
 	err  error
+	peer *PeerInfo // Nil if the sender is not authenticated.
 }
 
-// HTTPTransporter implements the Transporter atop http.
+// HTTPTransporter implements the Transporter atop http,
+// or https if the TLS options are given.
 type HTTPTransporter struct {
 	hostport    string // Local address.
+	scheme      string
+	serverTLS   *tls.Config
 	messageChan chan *message
+	peers       *peerCounters
 	mux         *http.ServeMux
 	client      *http.Client
+	server      *http.Server
+	logger      logger.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	stop     chan struct{}
+	stopped  bool
 }
 
 const defaultPrefix = "/messenger"
 const defaultChanSize = 1024
 
+// The header that carries the address the sender listens on. It's
+// optional, a client that doesn't listen can post the bare message
+// without it, but then it cannot be replied to.
+const fromHeader = "X-Messenger-From"
+
+// How long Stop() waits for the in-flight requests to finish.
+const defaultShutdownTimeout = time.Second * 5
+
 // NewHTTPTransporter creates a new http transporter.
-func NewHTTPTransporter(hostport string) *HTTPTransporter {
+func NewHTTPTransporter(hostport string, opts ...Option) *HTTPTransporter {
+	o := newOptions(opts)
+	// Keep the timeouts and the proxy settings of the default transport.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = o.clientTLS
 	t := &HTTPTransporter{
 		hostport:    hostport,
+		scheme:      "http",
+		serverTLS:   o.serverTLS,
 		messageChan: make(chan *message, defaultChanSize),
+		peers:       newPeerCounters(),
 		mux:         http.NewServeMux(),
-		client:      new(http.Client),
+		client:      &http.Client{Transport: tr},
+		stop:        make(chan struct{}),
+		logger:      o.logger,
 	}
 	t.mux.HandleFunc(defaultPrefix, t.messageHandler)
+	t.server = &http.Server{Handler: t.mux}
+	// The peers are expected to serve alike, so either config
+	// means https, with the system roots if there is no client TLS.
+	if o.clientTLS != nil || o.serverTLS != nil {
+		t.scheme = "https"
+	}
 	return t
 }
 
 // Send an encoded message to the host:port.
 // This will block.
 func (t *HTTPTransporter) Send(hostport string, b []byte) error {
-	targetURL := fmt.Sprintf("http://%s%s", hostport, defaultPrefix)
-	log.V(2).Infof("Sending message to %v\n", hostport)
-	resp, err := t.client.Post(targetURL, "application/messenger", bytes.NewReader(b))
+	err := t.send(hostport, b)
+	t.peers.sent(hostport, len(b), err)
+	return err
+}
+
+func (t *HTTPTransporter) send(hostport string, b []byte) error {
+	targetURL := fmt.Sprintf("%s://%s%s", t.scheme, hostport, defaultPrefix)
+	t.logger.Debugf("Sending message to %v\n", hostport)
+	req, err := http.NewRequest("POST", targetURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/messenger")
+	req.Header.Set(fromHeader, t.hostport)
+	resp, err := t.client.Do(req)
 	if resp == nil || err != nil {
-		log.Warningf("HTTPTransporter: Failed to POST: %v\n", err)
+		t.logger.Warningf("HTTPTransporter: Failed to POST: %v\n", err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.logger.Warningf("HTTPTransporter: Failed to POST: %v\n", resp.Status)
+		return fmt.Errorf("Failed to POST: %v", resp.Status)
+	}
 	return nil
 }
 
 // Recv receives a message in bytes from some peer.
 func (t *HTTPTransporter) Recv() (b []byte, err error) {
-	msg := <-t.messageChan
-	return msg.data, msg.err
+	_, b, err = t.RecvFrom()
+	return b, err
 }
 
-// Start the transporter, this will block unless some error happens.
-func (t *HTTPTransporter) Start() error {
-	if err := http.ListenAndServe(t.hostport, t.mux); err != nil {
+// RecvFrom receives a message in bytes from some peer,
+// along with the address of the peer.
+// It returns ErrStopped once the transporter is stopped.
+func (t *HTTPTransporter) RecvFrom() (hostport string, b []byte, err error) {
+	hostport, b, _, err = t.RecvFromPeer()
+	return hostport, b, err
+}
+
+// RecvFromPeer receives a message in bytes from some peer, along
+// with the address and the identity of the peer. The identity is
+// only known if the peer presents a verified client certificate.
+func (t *HTTPTransporter) RecvFromPeer() (hostport string, b []byte, peer *PeerInfo, err error) {
+	select {
+	case msg := <-t.messageChan:
+		if msg.err == nil {
+			t.peers.received(msg.from, len(msg.data))
+		}
+		return msg.from, msg.data, msg.peer, msg.err
+	case <-t.stop:
+		return "", nil, nil, ErrStopped
+	}
+}
+
+// Addr returns the local address.
+func (t *HTTPTransporter) Addr() string {
+	return t.hostport
+}
+
+// Listen binds the local address.
+// The connections are accepted over TLS if the server TLS is set.
+func (t *HTTPTransporter) Listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.listener != nil {
+		return fmt.Errorf("Transporter is already listening")
+	}
+	l, err := net.Listen("tcp", t.hostport)
+	if err != nil {
+		return err
+	}
+	if t.serverTLS != nil {
+		l = tls.NewListener(l, t.serverTLS)
+	}
+	t.listener = l
+	return nil
+}
+
+// Serve the incoming messages, this will block until it's
+// stopped or some error happens.
+func (t *HTTPTransporter) Serve() error {
+	t.mu.Lock()
+	l := t.listener
+	t.mu.Unlock()
+
+	if l == nil {
+		return fmt.Errorf("Transporter is not listening")
+	}
+	// Serve() closes the listener and returns immediately
+	// if the server is already shut down.
+	if err := t.server.Serve(l); err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
-// Stop the transporter. No-op for now.
+// Start the transporter, this will block until it's stopped
+// or some error happens.
+func (t *HTTPTransporter) Start() error {
+	if err := t.Listen(); err != nil {
+		return err
+	}
+	return t.Serve()
+}
+
+// Stop the transporter, close the listener and wait for the
+// in-flight requests to finish before the shutdown timeout.
 func (t *HTTPTransporter) Stop() error {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stopped = true
+	close(t.stop)
+	t.mu.Unlock()
+
+	t.client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	if err := t.server.Shutdown(ctx); err != nil {
+		t.logger.Warningf("HTTPTransporter: Failed to shutdown gracefully: %v\n", err)
+		return t.server.Close()
+	}
 	return nil
 }
 
@@ -80,8 +223,53 @@ func (t *HTTPTransporter) Destroy() error {
 func (t *HTTPTransporter) messageHandler(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Warningf("HTTPTransporter: Failed to read HTTP body: %v\n", err)
+		t.logger.Warningf("HTTPTransporter: Failed to read HTTP body: %v\n", err)
+	}
+	from := r.Header.Get(fromHeader)
+	t.logger.Debugf("Receiving message from %v (%v)\n", from, r.RemoteAddr)
+	peer := peerInfo(r.TLS)
+	if err := verifyFrom(from, peer); err != nil {
+		t.logger.Warningf("HTTPTransporter: Rejected message from %v: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	select {
+	case t.messageChan <- &message{from: from, data: b, err: err, peer: peer}:
+	case <-t.stop:
+		http.Error(w, ErrStopped.Error(), http.StatusServiceUnavailable)
 	}
-	log.V(2).Infof("Receiving message from %v\n", r.RemoteAddr)
-	t.messageChan <- &message{b, err}
+}
+
+// The identity of the peer if its certificate is verified.
+func peerInfo(state *tls.ConnectionState) *PeerInfo {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	return &PeerInfo{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Certificate: cert,
+	}
+}
+
+// Check the address claimed by an authenticated peer is one of its
+// certificate, so it cannot be replied to as some other peer.
+func verifyFrom(from string, peer *PeerInfo) error {
+	if from == "" || peer == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		host = from
+	}
+	if err := peer.Certificate.VerifyHostname(host); err != nil {
+		return fmt.Errorf("Address %v is not certified: %v", from, err)
+	}
+	return nil
+}
+
+// Stats returns the counters of the traffic with each peer.
+func (t *HTTPTransporter) Stats() map[string]PeerStats {
+	return t.peers.snapshot()
 }
@@ -0,0 +1,196 @@
+package transporter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// MemoryNetwork is an in-process network that connects
+// MemoryTransporters by their host:port names, no sockets
+// are involved.
+type MemoryNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*MemoryTransporter
+}
+
+// NewMemoryNetwork creates a new in-process network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		nodes: make(map[string]*MemoryTransporter),
+	}
+}
+
+// Attach a transporter to the network.
+func (n *MemoryNetwork) attach(t *MemoryTransporter) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.nodes[t.hostport]; ok {
+		return fmt.Errorf("Address %v is already in use", t.hostport)
+	}
+	n.nodes[t.hostport] = t
+	return nil
+}
+
+// Detach a transporter from the network.
+func (n *MemoryNetwork) detach(t *MemoryTransporter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nodes[t.hostport] == t {
+		delete(n.nodes, t.hostport)
+	}
+}
+
+// Find the transporter that is attached at the host:port.
+func (n *MemoryNetwork) lookup(hostport string) (*MemoryTransporter, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	t, ok := n.nodes[hostport]
+	return t, ok
+}
+
+// MemoryTransporter implements the Transporter atop a MemoryNetwork.
+// It's useful for unit tests and single-process simulations.
+type MemoryTransporter struct {
+	hostport    string // Local address.
+	network     *MemoryNetwork
+	messageChan chan *message
+	peers       *peerCounters
+	logger      logger.Logger
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	started bool
+	stopped bool
+}
+
+// NewMemoryTransporter creates a new memory transporter that
+// will be attached to the network at the host:port once started.
+func NewMemoryTransporter(network *MemoryNetwork, hostport string, opts ...Option) *MemoryTransporter {
+	o := newOptions(opts)
+	return &MemoryTransporter{
+		hostport:    hostport,
+		network:     network,
+		messageChan: make(chan *message, defaultChanSize),
+		peers:       newPeerCounters(),
+		stop:        make(chan struct{}),
+		logger:      o.logger,
+	}
+}
+
+// Send an encoded message to the host:port.
+// This will block if the peer's queue is full.
+func (t *MemoryTransporter) Send(hostport string, b []byte) error {
+	err := t.send(hostport, b)
+	t.peers.sent(hostport, len(b), err)
+	return err
+}
+
+func (t *MemoryTransporter) send(hostport string, b []byte) error {
+	peer, ok := t.network.lookup(hostport)
+	if !ok {
+		t.logger.Warningf("MemoryTransporter: Unknown address %v\n", hostport)
+		return fmt.Errorf("Unknown address %v", hostport)
+	}
+	// Copy the bytes so the sender can reuse the buffer.
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case peer.messageChan <- &message{from: t.hostport, data: data}:
+		return nil
+	case <-peer.stop:
+		return fmt.Errorf("Unknown address %v", hostport)
+	}
+}
+
+// Recv receives a message in bytes from some peer.
+func (t *MemoryTransporter) Recv() (b []byte, err error) {
+	_, b, err = t.RecvFrom()
+	return b, err
+}
+
+// RecvFrom receives a message in bytes from some peer,
+// along with the address of the peer.
+// It returns ErrStopped once the transporter is stopped.
+func (t *MemoryTransporter) RecvFrom() (hostport string, b []byte, err error) {
+	select {
+	case msg := <-t.messageChan:
+		if msg.err == nil {
+			t.peers.received(msg.from, len(msg.data))
+		}
+		return msg.from, msg.data, msg.err
+	case <-t.stop:
+		return "", nil, ErrStopped
+	}
+}
+
+// Addr returns the local address.
+func (t *MemoryTransporter) Addr() string {
+	return t.hostport
+}
+
+// Listen attaches the transporter to the network, it fails
+// if the address is already in use.
+func (t *MemoryTransporter) Listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started || t.stopped {
+		return fmt.Errorf("Transporter cannot be started again")
+	}
+	if err := t.network.attach(t); err != nil {
+		return err
+	}
+	t.started = true
+	return nil
+}
+
+// Serve blocks until the transporter is stopped, the messages
+// are delivered by the senders directly.
+func (t *MemoryTransporter) Serve() error {
+	t.mu.Lock()
+	started := t.started
+	t.mu.Unlock()
+
+	if !started {
+		return fmt.Errorf("Transporter is not listening")
+	}
+	<-t.stop
+	return nil
+}
+
+// Start the transporter, this will block until it's stopped
+// or the address is already in use.
+func (t *MemoryTransporter) Start() error {
+	if err := t.Listen(); err != nil {
+		return err
+	}
+	return t.Serve()
+}
+
+// Stop the transporter, detach it from the network.
+func (t *MemoryTransporter) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.stopped {
+		t.network.detach(t)
+		close(t.stop)
+		t.stopped = true
+	}
+	return nil
+}
+
+// Destroy the transporter.
+func (t *MemoryTransporter) Destroy() error {
+	return nil
+}
+
+// Stats returns the counters of the traffic with each peer.
+func (t *MemoryTransporter) Stats() map[string]PeerStats {
+	return t.peers.snapshot()
+}
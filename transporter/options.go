@@ -0,0 +1,80 @@
+package transporter
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// The configurable settings of a transporter.
+type options struct {
+	logger       logger.Logger
+	serverTLS    *tls.Config
+	clientTLS    *tls.Config
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+}
+
+func defaultOptions() *options {
+	return &options{
+		logger:       logger.Default(),
+		writeTimeout: defaultWriteTimeout,
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Option configures a transporter.
+type Option func(*options)
+
+// WithLogger sets the logger, which writes to stderr by default.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithServerTLS makes the HTTPTransporter serve over TLS, and send
+// over TLS too. For mutual TLS, set the ClientAuth to
+// RequireAndVerifyClientCert and the ClientCAs to the pool that signs
+// the peers' certificates, then the address a peer claims to listen
+// on must be one of its certificate.
+func WithServerTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.serverTLS = cfg
+	}
+}
+
+// WithClientTLS makes the HTTPTransporter send over TLS.
+// For mutual TLS, set the Certificates to the one of this node.
+func WithClientTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.clientTLS = cfg
+	}
+}
+
+// WithWriteTimeout sets how long the TCPTransporter waits for a frame
+// to be written, the connection is dropped if it times out, so a stalled
+// peer doesn't block the sends. Zero means no timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = d
+	}
+}
+
+// WithReadTimeout sets how long the TCPTransporter waits for the next
+// frame on an incoming connection before dropping it. There is no timeout
+// by default, since a connection can be idle while the peer has nothing
+// to send.
+func WithReadTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = d
+	}
+}
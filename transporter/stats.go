@@ -0,0 +1,76 @@
+package transporter
+
+import (
+	"sync"
+)
+
+// PeerStats are the counters of the traffic with a peer.
+type PeerStats struct {
+	MessagesSent     int64
+	MessagesReceived int64
+	BytesSent        int64
+	BytesReceived    int64
+	SendErrors       int64
+}
+
+// StatsReporter is implemented by the transporters that
+// count the traffic with each peer.
+type StatsReporter interface {
+	// Stats returns a snapshot of the counters keyed by the
+	// address of the peer.
+	Stats() map[string]PeerStats
+}
+
+// The per peer counters shared by the transporters.
+type peerCounters struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStats
+}
+
+func newPeerCounters() *peerCounters {
+	return &peerCounters{peers: make(map[string]*PeerStats)}
+}
+
+func (c *peerCounters) get(hostport string) *PeerStats {
+	s, ok := c.peers[hostport]
+	if !ok {
+		s = &PeerStats{}
+		c.peers[hostport] = s
+	}
+	return s
+}
+
+// Record the result of sending n bytes to the peer.
+func (c *peerCounters) sent(hostport string, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.get(hostport)
+	if err != nil {
+		s.SendErrors++
+		return
+	}
+	s.MessagesSent++
+	s.BytesSent += int64(n)
+}
+
+// Record the n bytes received from the peer.
+func (c *peerCounters) received(hostport string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.get(hostport)
+	s.MessagesReceived++
+	s.BytesReceived += int64(n)
+}
+
+func (c *peerCounters) snapshot() map[string]PeerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]PeerStats, len(c.peers))
+	for k, v := range c.peers {
+		m[k] = *v
+	}
+	return m
+}
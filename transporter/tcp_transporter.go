@@ -0,0 +1,368 @@
+package transporter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/logger"
+)
+
+// The maximum size of a single frame, in bytes.
+const maxFrameSize = 64 * 1024 * 1024
+
+// The timeout for establishing a connection to a peer.
+const defaultDialTimeout = time.Second * 5
+
+// The default timeout for writing a frame.
+const defaultWriteTimeout = time.Second * 10
+
+// The size of the frame header, which stores the length
+// of the payload as a big endian uint32.
+const frameHeaderSize = 4
+
+// A persistent outgoing connection to a peer.
+type tcpConn struct {
+	sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// TCPTransporter implements the Transporter atop tcp.
+// It keeps one long-lived connection per peer, messages are
+// framed by a length prefix. The first frame on every connection
+// carries the address the dialing side listens on.
+type TCPTransporter struct {
+	hostport    string // Local address.
+	messageChan chan *message
+	peers       *peerCounters
+	logger      logger.Logger
+
+	writeTimeout time.Duration // Zero means no timeout.
+	readTimeout  time.Duration // Zero means no timeout.
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[string]*tcpConn   // Outgoing connections.
+	accepted map[net.Conn]struct{} // Incoming connections.
+	stop     chan struct{}
+	stopped  bool
+}
+
+// NewTCPTransporter creates a new tcp transporter.
+func NewTCPTransporter(hostport string, opts ...Option) *TCPTransporter {
+	o := newOptions(opts)
+	return &TCPTransporter{
+		hostport:    hostport,
+		messageChan: make(chan *message, defaultChanSize),
+		peers:       newPeerCounters(),
+		conns:       make(map[string]*tcpConn),
+		accepted:    make(map[net.Conn]struct{}),
+		stop:        make(chan struct{}),
+		logger:      o.logger,
+
+		writeTimeout: o.writeTimeout,
+		readTimeout:  o.readTimeout,
+	}
+}
+
+// Send an encoded message to the host:port.
+// This will block. The connection is established on the first
+// Send to the peer, and re-established if the previous one fails.
+func (t *TCPTransporter) Send(hostport string, b []byte) error {
+	err := t.send(hostport, b)
+	t.peers.sent(hostport, len(b), err)
+	return err
+}
+
+func (t *TCPTransporter) send(hostport string, b []byte) error {
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("Message too large: %d bytes", len(b))
+	}
+	c, err := t.getConn(hostport)
+	if err != nil {
+		t.logger.Warningf("TCPTransporter: Failed to dial: %v\n", err)
+		return err
+	}
+	if err = t.writeFrame(c, b); err == nil {
+		return nil
+	}
+
+	// The connection might be broken because the peer
+	// restarted, so reconnect and try once more.
+	t.logger.Debugf("TCPTransporter: Reconnecting to %v: %v\n", hostport, err)
+	t.closeConn(hostport, c)
+	if c, err = t.getConn(hostport); err != nil {
+		t.logger.Warningf("TCPTransporter: Failed to dial: %v\n", err)
+		return err
+	}
+	if err = t.writeFrame(c, b); err != nil {
+		t.logger.Warningf("TCPTransporter: Failed to write: %v\n", err)
+		t.closeConn(hostport, c)
+		return err
+	}
+	return nil
+}
+
+// Recv receives a message in bytes from some peer.
+func (t *TCPTransporter) Recv() (b []byte, err error) {
+	_, b, err = t.RecvFrom()
+	return b, err
+}
+
+// RecvFrom receives a message in bytes from some peer,
+// along with the address of the peer.
+// It returns ErrStopped once the transporter is stopped.
+func (t *TCPTransporter) RecvFrom() (hostport string, b []byte, err error) {
+	select {
+	case msg := <-t.messageChan:
+		if msg.err == nil {
+			t.peers.received(msg.from, len(msg.data))
+		}
+		return msg.from, msg.data, msg.err
+	case <-t.stop:
+		return "", nil, ErrStopped
+	}
+}
+
+// Addr returns the local address.
+func (t *TCPTransporter) Addr() string {
+	return t.hostport
+}
+
+// Listen binds the local address.
+func (t *TCPTransporter) Listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return ErrStopped
+	}
+	if t.listener != nil {
+		return fmt.Errorf("Transporter is already listening")
+	}
+	l, err := net.Listen("tcp", t.hostport)
+	if err != nil {
+		return err
+	}
+	t.listener = l
+	return nil
+}
+
+// Serve the incoming messages, this will block until it's
+// stopped or some error happens.
+func (t *TCPTransporter) Serve() error {
+	t.mu.Lock()
+	l := t.listener
+	t.mu.Unlock()
+
+	if l == nil {
+		return fmt.Errorf("Transporter is not listening")
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			t.mu.Lock()
+			stopped := t.stopped
+			t.mu.Unlock()
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		t.mu.Lock()
+		if t.stopped {
+			// Stop() has closed the other connections.
+			t.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		t.accepted[conn] = struct{}{}
+		t.mu.Unlock()
+		go t.readLoop(conn)
+	}
+}
+
+// Start the transporter, this will block until it's stopped
+// or some error happens.
+func (t *TCPTransporter) Start() error {
+	if err := t.Listen(); err != nil {
+		return err
+	}
+	return t.Serve()
+}
+
+// Stop the transporter, close the listener and all the connections.
+func (t *TCPTransporter) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return nil
+	}
+	t.stopped = true
+	close(t.stop)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for hostport, c := range t.conns {
+		c.conn.Close()
+		delete(t.conns, hostport)
+	}
+	for conn := range t.accepted {
+		conn.Close()
+		delete(t.accepted, conn)
+	}
+	return nil
+}
+
+// Destroy the transporter.
+func (t *TCPTransporter) Destroy() error {
+	return nil
+}
+
+// Get the connection to the peer, dial if there is none.
+// The lock is not held while dialing, so a peer that is down
+// doesn't block the sends to the others.
+func (t *TCPTransporter) getConn(hostport string) (*tcpConn, error) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if c, ok := t.conns[hostport]; ok {
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", hostport, defaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &tcpConn{conn: conn, w: bufio.NewWriter(conn)}
+	// Tell the peer who we are.
+	if err = t.writeFrame(c, []byte(t.hostport)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		conn.Close()
+		return nil, ErrStopped
+	}
+	if other, ok := t.conns[hostport]; ok {
+		// Someone else has dialed in the meantime.
+		conn.Close()
+		return other, nil
+	}
+	t.conns[hostport] = c
+	return c, nil
+}
+
+// Close the connection and forget it if it's still the current one.
+func (t *TCPTransporter) closeConn(hostport string, c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c.conn.Close()
+	if t.conns[hostport] == c {
+		delete(t.conns, hostport)
+	}
+}
+
+// Write a length prefixed frame to the connection.
+// The caller drops the connection if it fails, e.g. times out.
+func (t *TCPTransporter) writeFrame(c *tcpConn, b []byte) error {
+	var header [frameHeaderSize]byte
+
+	binary.BigEndian.PutUint32(header[:], uint32(len(b)))
+
+	c.Lock()
+	defer c.Unlock()
+
+	if t.writeTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// Read frames from an incoming connection until it's closed.
+func (t *TCPTransporter) readLoop(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		t.mu.Lock()
+		delete(t.accepted, conn)
+		t.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	t.setReadDeadline(conn)
+	b, err := readFrame(r)
+	if err != nil {
+		t.logger.Warningf("TCPTransporter: Failed to read handshake: %v\n", err)
+		return
+	}
+	from := string(b)
+	t.logger.Debugf("TCPTransporter: Accepted connection from %v (%v)\n", from, conn.RemoteAddr())
+
+	for {
+		t.setReadDeadline(conn)
+		b, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				t.logger.Debugf("TCPTransporter: Failed to read frame: %v\n", err)
+			}
+			return
+		}
+		select {
+		case t.messageChan <- &message{from: from, data: b}:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Give the peer the read timeout to send the next frame.
+func (t *TCPTransporter) setReadDeadline(conn net.Conn) {
+	if t.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
+}
+
+// Read a length prefixed frame from the reader.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("Frame too large: %d bytes", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Stats returns the counters of the traffic with each peer.
+func (t *TCPTransporter) Stats() map[string]PeerStats {
+	return t.peers.snapshot()
+}
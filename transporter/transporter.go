@@ -1,5 +1,14 @@
 package transporter
 
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// ErrStopped is returned by Recv() and RecvFrom() once
+// the transporter is stopped.
+var ErrStopped = errors.New("Transporter is stopped")
+
 // Transporter defines interfaces of a transporter, including
 // Send and Recv.
 type Transporter interface {
@@ -10,9 +19,30 @@ type Transporter interface {
 
 	// Receive an encoded message from some peer.
 	// Return the bytes form of the message.
+	// Return ErrStopped if the transporter is stopped.
 	Recv() (b []byte, err error)
 
-	// Start the transporter, this will block unless some error happens.
+	// Receive an encoded message from some peer, along with
+	// the address of the peer. The address is the one the peer
+	// listens on, not the address of the underlying connection.
+	RecvFrom() (hostport string, b []byte, err error)
+
+	// Addr returns the local address the transporter
+	// listens on, in the form of host:port.
+	Addr() string
+
+	// Listen binds the local address, it returns once the
+	// transporter is ready to accept incoming messages.
+	Listen() error
+
+	// Serve the incoming messages, this will block until the
+	// transporter is stopped or some error happens.
+	// Listen must be called first.
+	Serve() error
+
+	// Start the transporter, which is Listen followed by Serve.
+	// This will block until the transporter is stopped or some
+	// error happens.
 	Start() error
 
 	// Stop the transporter.
@@ -21,3 +51,21 @@ type Transporter interface {
 	// Destroy the transporter.
 	Destroy() error
 }
+
+// PeerInfo is the identity of a peer verified by the transporter.
+type PeerInfo struct {
+	// The common name of the subject of the peer's certificate.
+	CommonName string
+	// The DNS names of the peer's certificate.
+	DNSNames []string
+	// The verified certificate of the peer.
+	Certificate *x509.Certificate
+}
+
+// PeerReceiver is implemented by the transporters that can
+// authenticate the peers, like the HTTPTransporter with mTLS.
+type PeerReceiver interface {
+	// RecvFromPeer is RecvFrom along with the verified identity
+	// of the peer, which is nil if the peer is not authenticated.
+	RecvFromPeer() (hostport string, b []byte, peer *PeerInfo, err error)
+}
@@ -1,8 +1,18 @@
 package transporter
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
 	"testing"
 	"time"
 
@@ -37,8 +47,9 @@ func testTransporter(t *testing.T, s, r Transporter, target string) {
 	// Receive.
 	go func() {
 		for i := 0; i < len(expectedData); i++ {
-			b, err := r.Recv()
+			from, b, err := r.RecvFrom()
 			assert.NoError(t, err)
+			assert.Equal(t, s.Addr(), from)
 			actualData[i] = b
 		}
 		close(done)
@@ -94,15 +105,15 @@ func TestHTTPTransporter(t *testing.T) {
 	receiver := NewHTTPTransporter("localhost:8081")
 	assert.NotNil(t, receiver)
 
+	assert.NoError(t, sender.Listen())
+	assert.NoError(t, receiver.Listen())
 	go func() {
-		assert.NoError(t, sender.Start())
+		assert.NoError(t, sender.Serve())
 	}()
 	go func() {
-		assert.NoError(t, receiver.Start())
+		assert.NoError(t, receiver.Serve())
 	}()
 
-	time.Sleep(time.Second)
-
 	testTransporter(t, sender, receiver, "localhost:8081")
 }
 
@@ -118,14 +129,456 @@ func BenchmarkHTTPTransporter(b *testing.B) {
 	receiver := NewHTTPTransporter(r)
 	assert.NotNil(b, receiver)
 
+	assert.NoError(b, sender.Listen())
+	assert.NoError(b, receiver.Listen())
+	go func() {
+		assert.NoError(b, sender.Serve())
+	}()
+	go func() {
+		assert.NoError(b, receiver.Serve())
+	}()
+
+	benchmarkTransporter(b, sender, receiver, r)
+}
+
+// Test the TCPTransporter.
+func TestTCPTransporter(t *testing.T) {
+	sender := NewTCPTransporter("localhost:8082")
+	assert.NotNil(t, sender)
+
+	receiver := NewTCPTransporter("localhost:8083")
+	assert.NotNil(t, receiver)
+	defer sender.Stop()
+	defer receiver.Stop()
+
+	assert.NoError(t, sender.Listen())
+	assert.NoError(t, receiver.Listen())
+	go func() {
+		assert.NoError(t, sender.Serve())
+	}()
 	go func() {
-		assert.NoError(b, sender.Start())
+		assert.NoError(t, receiver.Serve())
 	}()
+
+	testTransporter(t, sender, receiver, "localhost:8083")
+}
+
+// Test the TCPTransporter reconnects once the peer restarts.
+func TestTCPTransporterReconnect(t *testing.T) {
+	sender := NewTCPTransporter("localhost:8088")
+	defer sender.Stop()
+
+	startReceiver := func() *TCPTransporter {
+		r := NewTCPTransporter("localhost:8089")
+		assert.NoError(t, r.Listen())
+		go func() {
+			assert.NoError(t, r.Serve())
+		}()
+		return r
+	}
+	receiver := startReceiver()
+	assert.NoError(t, sender.Send("localhost:8089", []byte("hello")))
+	_, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+
+	// The writes to the broken connection might succeed
+	// for a while, but the dial should fail eventually.
+	assert.NoError(t, receiver.Stop())
+	failed := false
+	for i := 0; i < 100 && !failed; i++ {
+		failed = sender.Send("localhost:8089", []byte("lost")) != nil
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, failed)
+
+	// Should reconnect on the next Send.
+	receiver = startReceiver()
+	defer receiver.Stop()
+	assert.NoError(t, sender.Send("localhost:8089", []byte("hello again")))
+	from, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8088", from)
+	assert.Equal(t, []byte("hello again"), b)
+}
+
+// Test the TCPTransporter drops the stalled connections.
+func TestTCPTransporterTimeout(t *testing.T) {
+	// A peer that accepts the connections but never reads.
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tr := NewTCPTransporter("localhost:8090", WithWriteTimeout(time.Millisecond*100),
+		WithReadTimeout(time.Millisecond*100))
+	assert.NoError(t, tr.Listen())
 	go func() {
-		assert.NoError(b, receiver.Start())
+		assert.NoError(t, tr.Serve())
 	}()
+	defer tr.Stop()
 
-	time.Sleep(time.Second)
+	// Should give up once the buffers are full.
+	start := time.Now()
+	assert.Error(t, tr.Send(l.Addr().String(), make([]byte, maxFrameSize)))
+	assert.True(t, time.Since(start) < time.Second*5)
+
+	// Should close an incoming connection that stays idle.
+	conn, err := net.Dial("tcp", "localhost:8090")
+	assert.NoError(t, err)
+	defer conn.Close()
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], 4)
+	_, err = conn.Write(append(header[:], "peer"...))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(header[:])
+	assert.Equal(t, io.EOF, err)
+}
+
+// Benchmark the TCPTransporter.
+func BenchmarkTCPTransporter(b *testing.B) {
+	// Use random port to avoid port collision (hopefully).
+	port := rand.Intn(100) + 8200
+	s := fmt.Sprintf("localhost:%d", port)
+	r := fmt.Sprintf("localhost:%d", port+1)
+	sender := NewTCPTransporter(s)
+	assert.NotNil(b, sender)
+
+	receiver := NewTCPTransporter(r)
+	assert.NotNil(b, receiver)
+
+	assert.NoError(b, sender.Listen())
+	assert.NoError(b, receiver.Listen())
+	go func() {
+		assert.NoError(b, sender.Serve())
+	}()
+	go func() {
+		assert.NoError(b, receiver.Serve())
+	}()
 
 	benchmarkTransporter(b, sender, receiver, r)
 }
+
+// Test the MemoryTransporter.
+func TestMemoryTransporter(t *testing.T) {
+	network := NewMemoryNetwork()
+	sender := NewMemoryTransporter(network, "sender")
+	assert.NotNil(t, sender)
+
+	receiver := NewMemoryTransporter(network, "receiver")
+	assert.NotNil(t, receiver)
+
+	// Should fail because the address is taken.
+	duplicate := NewMemoryTransporter(network, "receiver")
+
+	assert.NoError(t, sender.Listen())
+	assert.NoError(t, receiver.Listen())
+	go func() {
+		assert.NoError(t, sender.Serve())
+	}()
+	go func() {
+		assert.NoError(t, receiver.Serve())
+	}()
+
+	assert.Error(t, duplicate.Listen())
+	assert.Error(t, sender.Send("unknown", []byte("hello")))
+
+	testTransporter(t, sender, receiver, "receiver")
+
+	// Should count the traffic with each peer.
+	sent := sender.Stats()
+	assert.Equal(t, int64(2048), sent["receiver"].MessagesSent)
+	assert.Equal(t, int64(1), sent["unknown"].SendErrors)
+	received := receiver.Stats()
+	assert.Equal(t, int64(2048), received["sender"].MessagesReceived)
+	assert.Equal(t, sent["receiver"].BytesSent, received["sender"].BytesReceived)
+}
+
+// Benchmark the MemoryTransporter.
+func BenchmarkMemoryTransporter(b *testing.B) {
+	network := NewMemoryNetwork()
+	sender := NewMemoryTransporter(network, "sender")
+	assert.NotNil(b, sender)
+
+	receiver := NewMemoryTransporter(network, "receiver")
+	assert.NotNil(b, receiver)
+
+	assert.NoError(b, sender.Listen())
+	assert.NoError(b, receiver.Listen())
+	go func() {
+		assert.NoError(b, sender.Serve())
+	}()
+	go func() {
+		assert.NoError(b, receiver.Serve())
+	}()
+
+	benchmarkTransporter(b, sender, receiver, "receiver")
+}
+
+// Test the Stop() of the HTTPTransporter.
+func TestHTTPTransporterStop(t *testing.T) {
+	tr := NewHTTPTransporter("localhost:8084")
+	assert.NotNil(t, tr)
+
+	done := make(chan error)
+	assert.NoError(t, tr.Listen())
+	go func() {
+		done <- tr.Serve()
+	}()
+
+	assert.NoError(t, tr.Send("localhost:8084", []byte("hello")))
+	b, err := tr.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), b)
+
+	assert.NoError(t, tr.Stop())
+	// Stop() should be idempotent.
+	assert.NoError(t, tr.Stop())
+
+	// Serve() should return once stopped.
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve() does not return after Stop()")
+	}
+
+	// Recv() should not block.
+	_, err = tr.Recv()
+	assert.Equal(t, ErrStopped, err)
+
+	// The port should be released.
+	tr = NewHTTPTransporter("localhost:8084")
+	assert.NoError(t, tr.Listen())
+	go func() {
+		done <- tr.Serve()
+	}()
+	assert.NoError(t, tr.Send("localhost:8084", []byte("world")))
+	assert.NoError(t, tr.Stop())
+	assert.NoError(t, <-done)
+}
+
+func TestFaultyTransporter(t *testing.T) {
+	network := NewMemoryNetwork()
+	sender := NewFaultyTransporter(NewMemoryTransporter(network, "sender"), Faults{})
+	receiver := NewFaultyTransporter(NewMemoryTransporter(network, "receiver"), Faults{})
+	assert.NoError(t, sender.Listen())
+	assert.NoError(t, receiver.Listen())
+	sender.SetSeed(1)
+
+	// Receive the messages that arrive in a short while.
+	recvAll := func() [][]byte {
+		var data [][]byte
+		for {
+			done := make(chan []byte)
+			go func() {
+				_, b, err := receiver.RecvFrom()
+				if err == nil {
+					done <- b
+				}
+			}()
+			select {
+			case b := <-done:
+				data = append(data, b)
+			case <-time.After(time.Millisecond * 100):
+				// Let the pending RecvFrom() take the next message.
+				assert.NoError(t, sender.Send("receiver", []byte("flush")))
+				assert.Equal(t, []byte("flush"), <-done)
+				return data
+			}
+		}
+	}
+	hello := []byte("hello")
+
+	// Should pass without faults.
+	assert.NoError(t, sender.Send("receiver", hello))
+	assert.Equal(t, [][]byte{hello}, recvAll())
+
+	// Should drop all the messages.
+	sender.SetFaults(Faults{DropRate: 1})
+	assert.NoError(t, sender.Send("receiver", hello))
+	sender.SetFaults(Faults{})
+	assert.Empty(t, recvAll())
+	assert.Equal(t, int64(1), sender.Injected().Dropped)
+
+	// Should send twice.
+	sender.SetFaults(Faults{DuplicateRate: 1})
+	assert.NoError(t, sender.Send("receiver", hello))
+	sender.SetFaults(Faults{})
+	assert.Equal(t, [][]byte{hello, hello}, recvAll())
+
+	// Should flip a byte, and leave the caller's buffer untouched.
+	sender.SetFaults(Faults{CorruptRate: 1})
+	assert.NoError(t, sender.Send("receiver", hello))
+	sender.SetFaults(Faults{})
+	data := recvAll()
+	assert.Equal(t, 1, len(data))
+	assert.NotEqual(t, hello, data[0])
+	assert.Equal(t, []byte("hello"), hello)
+
+	// Should delay the messages without blocking the sender.
+	sender.SetFaults(Faults{Latency: time.Millisecond * 50, Jitter: time.Millisecond * 10})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, sender.Send("receiver", hello))
+	}
+	assert.True(t, time.Since(start) < time.Millisecond*50)
+	sender.SetFaults(Faults{})
+	_, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, hello, b)
+	assert.True(t, time.Since(start) >= time.Millisecond*50)
+	assert.Equal(t, 9, len(recvAll()))
+	// The delays overlap rather than add up.
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+
+	// Should block the directions independently.
+	sender.BlockOutbound("receiver")
+	assert.NoError(t, sender.Send("receiver", hello))
+	sender.Heal()
+	assert.Empty(t, recvAll())
+	receiver.BlockInbound("sender")
+	assert.NoError(t, sender.Send("receiver", hello))
+	assert.NoError(t, receiver.Send("sender", hello))
+	_, b, err = sender.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, hello, b)
+	// The message from the sender comes first, but is dropped.
+	other := NewMemoryTransporter(network, "other")
+	assert.NoError(t, other.Listen())
+	assert.NoError(t, other.Send("receiver", []byte("world")))
+	from, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "other", from)
+	assert.Equal(t, []byte("world"), b)
+	receiver.Unblock("sender")
+	assert.Empty(t, recvAll())
+	assert.Equal(t, int64(1), sender.Injected().Blocked)
+	assert.Equal(t, int64(1), receiver.Injected().Blocked)
+
+	// Should report the counters of the wrapped transporter.
+	assert.Equal(t, int64(1), receiver.Stats()["sender"].MessagesSent)
+
+	assert.NoError(t, sender.Stop())
+	assert.NoError(t, receiver.Stop())
+	assert.NoError(t, other.Stop())
+}
+
+// A certificate authority for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// Issue a certificate for localhost with the common name,
+// which can be used by both the server and the client.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Create a transporter that requires and presents the certificates.
+func newMutualTLSTransporter(ca *testCA, cert tls.Certificate, hostport string) *HTTPTransporter {
+	return NewHTTPTransporter(hostport,
+		WithServerTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+		}),
+		WithClientTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca.pool,
+		}))
+}
+
+func TestHTTPTransporterTLS(t *testing.T) {
+	ca := newTestCA(t)
+	sender := newMutualTLSTransporter(ca, ca.issue(t, "sender"), "localhost:8085")
+	receiver := newMutualTLSTransporter(ca, ca.issue(t, "receiver"), "localhost:8086")
+	assert.NoError(t, sender.Listen())
+	assert.NoError(t, receiver.Listen())
+	go sender.Serve()
+	go receiver.Serve()
+
+	// Should tell the verified identity of the sender.
+	assert.NoError(t, sender.Send("localhost:8086", []byte("hello")))
+	from, b, peer, err := receiver.RecvFromPeer()
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8085", from)
+	assert.Equal(t, []byte("hello"), b)
+	assert.NotNil(t, peer)
+	assert.Equal(t, "sender", peer.CommonName)
+	assert.Equal(t, []string{"localhost"}, peer.DNSNames)
+
+	// Should reject the address that is not certified.
+	liar := newMutualTLSTransporter(ca, ca.issue(t, "liar"), "127.0.0.2:8087")
+	err = liar.Send("localhost:8086", []byte("hello"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+
+	// Should send over TLS if only the server TLS is set.
+	assert.Equal(t, "https", NewHTTPTransporter("localhost:8087", WithServerTLS(&tls.Config{})).scheme)
+
+	// Should reject the plaintext peers.
+	plain := NewHTTPTransporter("localhost:8087")
+	assert.Error(t, plain.Send("localhost:8086", []byte("hello")))
+
+	// Should reject the peers signed by other authorities.
+	other := newTestCA(t)
+	stranger := newMutualTLSTransporter(ca, other.issue(t, "stranger"), "localhost:8087")
+	assert.Error(t, stranger.Send("localhost:8086", []byte("hello")))
+
+	// Should not trust the server signed by other authorities.
+	impostor := newMutualTLSTransporter(ca, other.issue(t, "impostor"), "localhost:8087")
+	assert.NoError(t, impostor.Listen())
+	go impostor.Serve()
+	assert.Error(t, sender.Send("localhost:8087", []byte("hello")))
+
+	assert.NoError(t, sender.Stop())
+	assert.NoError(t, receiver.Stop())
+	assert.NoError(t, impostor.Stop())
+}